@@ -13,7 +13,7 @@ set -m
 sleep 10
 
 # Create cluster, minimal settings for testing
-/opt/couchbase/bin/couchbase-cli cluster-init -c localhost --cluster-username halcouch --cluster-password couchpass --services data,index,query
+/opt/couchbase/bin/couchbase-cli cluster-init -c localhost --cluster-username halcouch --cluster-password couchpass --services data,index,query --cluster-ramsize 512
 
 # Create bucket, minimal settings for testing
 /opt/couchbase/bin/couchbase-cli bucket-create -c localhost --username halcouch --password couchpass --bucket recipes --bucket-type couchbase --bucket-ramsize 100 --enable-flush=1
@@ -0,0 +1,40 @@
+package application
+
+import (
+	// native packages
+	"crypto/subtle"
+	"errors"
+	"net/http"
+)
+
+// adminHeader carries the admin token; the Authorization header is left
+// to the tenant tokens, so that an admin may name the tenant to work on.
+const adminHeader = "X-Admin-Token"
+
+// Admin API errors.
+var (
+	errAdminDisabled = errors.New("the admin API is disabled: no admin token is configured")
+	errNotAdmin      = errors.New("missing or invalid " + adminHeader + " header")
+)
+
+// requireAdmin responds with 401 Unauthorized unless the request carries
+// the admin token, or with 403 Forbidden if no admin token is configured.
+func (a *App) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if a.AdminToken == "" {
+			respondWithError(w, http.StatusForbidden, errAdminDisabled.Error())
+			return
+		}
+		if !a.isAdmin(req) {
+			respondWithError(w, http.StatusUnauthorized, errNotAdmin.Error())
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// isAdmin reports whether the request carries the admin token
+func (a *App) isAdmin(req *http.Request) bool {
+	token := req.Header.Get(adminHeader)
+	return a.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.AdminToken)) == 1
+}
@@ -2,29 +2,82 @@ package application
 
 import (
 	// native packages
-	"encoding/json"
-	"log"
+	"context"
 	"net/http"
 	"strconv"
+	"time"
 	// local packages
-	"recipes"
+	"restful_couchbase/recipes"
 	// external packages
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
 	"gopkg.in/couchbase/gocb.v1"
 )
 
 // App represents the application
 type App struct {
-	Router  *mux.Router
-	Manager *gocb.BucketManager
-	DB      *gocb.Bucket
+	Router    *mux.Router
+	Manager   *gocb.BucketManager
+	DB        *recipes.Bucket
+	Blocklist *recipes.Blocklist
+
+	// AdminToken is required by the admin API, in the X-Admin-Token
+	// header, if empty the admin API is disabled
+	AdminToken string
+	// RatingPrior configures the ranking score of rated recipes
+	RatingPrior recipes.RatingPrior
+
+	// SearchIndex names the Couchbase full-text index used for text searches,
+	// if empty an in-process index is used instead
+	SearchIndex string
+
+	// TemplateDir holds templates overriding the default recipe cards
+	TemplateDir string
+
+	// ConnectAttempts bounds the attempts to connect to Couchbase at
+	// startup, if zero a default is used
+	ConnectAttempts int
+
+	// SkipIndexes disables creating the required indexes on startup
+	SkipIndexes bool
+
+	// MigrateOnStart upgrades the stored recipes in the background once
+	// connected, as the migrate command does
+	MigrateOnStart bool
+
+	// MultiTenant serves each request from the bucket of its tenant, see tenants.go
+	MultiTenant bool
+
+	// TenantSecret verifies the HS256 tokens naming a tenant, if empty
+	// tokens are not accepted
+	TenantSecret []byte
+
+	// TenantBucketQuota is the memory quota, in MB, of the buckets created
+	// for tenants, if zero a default is used
+	TenantBucketQuota int
+
+	cards        map[string]cardTemplate
+	store        storeState
+	cluster      *gocb.Cluster
+	user         string
+	password     string
+	dbname       string
+	defaultStore *tenantStore
+	tenants      tenantRegistry
 }
 
+// textIndexTTL is how long the in-process text index is used before being rebuilt
+const textIndexTTL = time.Minute
+
+// nameTrieTTL is how long the suggestions trie is used before being rebuilt
+const nameTrieTTL = time.Minute
+
 func (a *App) getRecipeEndpoint(w http.ResponseWriter, req *http.Request) {
 	params := mux.Vars(req)
 	recipeID := params["id"]
 	r := recipes.Recipe{}
-	if err := r.GetRecipe(recipeID, a.DB); err != nil {
+	if err := r.GetRecipe(recipeID, a.db(req)); err != nil {
 		if gocb.IsKeyNotFoundError(err) {
 			respondWithError(w, http.StatusNotFound, err.Error())
 		} else {
@@ -32,53 +85,56 @@ func (a *App) getRecipeEndpoint(w http.ResponseWriter, req *http.Request) {
 		}
 		return
 	}
-	respondWithJSON(w, http.StatusOK, r)
+	if negotiatedType(w) == ldJSON {
+		respondWithJSONLD(w, http.StatusOK, r.Rated(recipeID, a.RatingPrior))
+		return
+	}
+	if t, ok := a.cards[negotiatedType(w)]; ok {
+		card, err := renderCard(t, r.Rated(recipeID, a.RatingPrior))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", negotiatedType(w)+"; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write(card)
+		return
+	}
+	respond(w, http.StatusOK, r)
 }
 
 func (a *App) getRecipesEndpoint(w http.ResponseWriter, req *http.Request) {
-	count, _ := strconv.Atoi(req.FormValue("count"))
-	start, _ := strconv.Atoi(req.FormValue("start"))
-
-	if count > 10 || count < 1 {
-		count = 10
-	}
-	if start < 0 {
-		start = 0
-	}
-	recipes, err := recipes.GetRecipes(a.DB, start, count)
+	start, count := pagination(req)
+	recipes, err := recipes.GetRecipes(a.db(req), start, count)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	respondWithJSON(w, http.StatusOK, recipes)
+	respond(w, http.StatusOK, recipes)
 }
 
 func (a *App) createRecipeEndpoint(w http.ResponseWriter, req *http.Request) {
 	var r recipes.Recipe
-	decoder := json.NewDecoder(req.Body)
-	if err := decoder.Decode(&r); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+	if !decodeRecipe(w, req, &r) {
 		return
 	}
-	defer req.Body.Close()
-	if err := r.CreateRecipe(a.DB); err != nil {
+	r.Moderate(a.Blocklist)
+	if err := r.CreateRecipe(a.db(req)); err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	respondWithJSON(w, http.StatusCreated, r)
+	respond(w, http.StatusCreated, r)
 }
 
 func (a *App) modifyRecipeEndpoint(w http.ResponseWriter, req *http.Request) {
 	params := mux.Vars(req)
 	recipeID := params["id"]
 	var r recipes.Recipe
-	decoder := json.NewDecoder(req.Body)
-	if err := decoder.Decode(&r); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+	if !decodeRecipe(w, req, &r) {
 		return
 	}
-	defer req.Body.Close()
-	if err := r.UpdateRecipe(recipeID, a.DB); err != nil {
+	r.Moderate(a.Blocklist)
+	if err := r.UpdateRecipe(recipeID, a.db(req)); err != nil {
 		if gocb.IsKeyNotFoundError(err) {
 			respondWithError(w, http.StatusNotFound, err.Error())
 		} else {
@@ -86,14 +142,14 @@ func (a *App) modifyRecipeEndpoint(w http.ResponseWriter, req *http.Request) {
 		}
 		return
 	}
-	respondWithJSON(w, http.StatusOK, r)
+	respond(w, http.StatusOK, r)
 }
 
 func (a *App) deleteRecipeEndpoint(w http.ResponseWriter, req *http.Request) {
 	params := mux.Vars(req)
 	recipeID := params["id"]
 	r := recipes.Recipe{}
-	if err := r.DeleteRecipe(recipeID, a.DB); err != nil {
+	if err := r.DeleteRecipe(recipeID, a.db(req)); err != nil {
 		if gocb.IsKeyNotFoundError(err) {
 			respondWithError(w, http.StatusNotFound, err.Error())
 		} else {
@@ -101,7 +157,7 @@ func (a *App) deleteRecipeEndpoint(w http.ResponseWriter, req *http.Request) {
 		}
 		return
 	}
-	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	respond(w, http.StatusOK, map[string]string{"result": "success"})
 }
 
 func (a *App) addRatingEndpoint(w http.ResponseWriter, req *http.Request) {
@@ -112,13 +168,10 @@ func (a *App) addRatingEndpoint(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	rr := recipes.RecipeRating{RecipeID: recipeID}
-	decoder := json.NewDecoder(req.Body)
-	if err := decoder.Decode(&rr); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+	if !decodeBody(w, req, &rr) {
 		return
 	}
-	defer req.Body.Close()
-	if err := rr.AddRecipeRating(a.DB); err != nil {
+	if err := rr.AddRecipeRating(a.db(req)); err != nil {
 		if gocb.IsKeyNotFoundError(err) {
 			respondWithError(w, http.StatusNotFound, err.Error())
 		} else {
@@ -126,80 +179,283 @@ func (a *App) addRatingEndpoint(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 	}
-	respondWithJSON(w, http.StatusCreated, rr)
+	respond(w, http.StatusCreated, rr)
 }
 
 func (a *App) searchRecipesEndpoint(w http.ResponseWriter, req *http.Request) {
-	count, _ := strconv.Atoi(req.FormValue("count"))
-	start, _ := strconv.Atoi(req.FormValue("start"))
+	start, count := pagination(req)
 
-	var preptime32 float32
+	filter := recipes.SearchFilter{
+		Query: req.FormValue("q"),
+		Sort:  req.FormValue("sort"),
+	}
 	if req.FormValue("preptime") == "" {
-		preptime32 = 9999.99 // random large value
+		filter.PrepTime = recipes.NoPrepTimeLimit
 	} else {
 		preptime64, _ := strconv.ParseFloat(req.FormValue("preptime"), 32)
-		preptime32 = float32(preptime64)
+		filter.PrepTime = float32(preptime64)
 	}
 
+	withFacets, _ := strconv.ParseBool(req.FormValue("facets"))
+
+	recipesRated, facets, err := a.searchRecipes(req, filter, start, count, withFacets)
+	if err != nil {
+		if err == recipes.ErrInvalidSort {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		} else {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	if withFacets {
+		respond(w, http.StatusOK, searchResults{Results: recipesRated, Facets: facets})
+		return
+	}
+	respond(w, http.StatusOK, recipesRated)
+}
+
+// searchResults is the response to a search which requested facet counts
+type searchResults struct {
+	Results []recipes.RecipeRated `json:"results"`
+	Facets  *recipes.Facets       `json:"facets"`
+}
+
+// searchRecipes returns a page of search results, and optionally facet counts
+// across all of the matching recipes. Text searches are ranked by relevance,
+// anything else by the requested sort key.
+func (a *App) searchRecipes(req *http.Request, filter recipes.SearchFilter, start, count int, withFacets bool) ([]recipes.RecipeRated, *recipes.Facets, error) {
+	db := a.db(req)
+	var recipesRated []recipes.RecipeRated
+	var ids []string
+	var err error
+	if filter.Query != "" {
+		recipesRated, ids, err = recipes.SearchRecipesText(db, a.tenant(req).text, filter, start, count, a.RatingPrior)
+	} else {
+		recipesRated, err = recipes.GetRecipesRated(db, start, count, filter.PrepTime, filter.Sort, a.RatingPrior)
+	}
+	if err != nil || !withFacets {
+		return recipesRated, nil, err
+	}
+	facets, err := recipes.GetSearchFacets(db, filter, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	return recipesRated, facets, nil
+}
+
+func (a *App) suggestRecipesEndpoint(w http.ResponseWriter, req *http.Request) {
+	count, _ := strconv.Atoi(req.FormValue("count"))
 	if count > 10 || count < 1 {
-		count = 10
+		count = 5
 	}
-	if start < 0 {
-		start = 0
+	suggestions, err := a.tenant(req).names.Suggest(a.db(req), req.FormValue("prefix"), count)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respond(w, http.StatusOK, suggestions)
+}
+
+func (a *App) getTopRecipesEndpoint(w http.ResponseWriter, req *http.Request) {
+	start, count := pagination(req)
+	recipesRated, err := recipes.GetTopRecipes(a.db(req), start, count, a.RatingPrior)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respond(w, http.StatusOK, recipesRated)
+}
+
+func (a *App) getTrendingRecipesEndpoint(w http.ResponseWriter, req *http.Request) {
+	start, count := pagination(req)
+
+	// The sliding window is specified in days, a week by default
+	days, _ := strconv.Atoi(req.FormValue("days"))
+	if days > 90 || days < 1 {
+		days = 7
+	}
+	window := time.Duration(days) * 24 * time.Hour
+
+	recipesRated, err := recipes.GetTrendingRecipes(a.db(req), start, count, window, a.RatingPrior)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
+	respond(w, http.StatusOK, recipesRated)
+}
 
-	recipesRated, err := recipes.GetRecipesRated(a.DB, start, count, preptime32)
+func (a *App) getNewRecipesEndpoint(w http.ResponseWriter, req *http.Request) {
+	start, count := pagination(req)
+	recipesRated, err := recipes.GetNewRecipes(a.db(req), start, count, a.RatingPrior)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	respondWithJSON(w, http.StatusOK, recipesRated)
+	respond(w, http.StatusOK, recipesRated)
 }
 
+func (a *App) getModerationQueueEndpoint(w http.ResponseWriter, req *http.Request) {
+	start, count := pagination(req)
+	status := req.FormValue("status")
+	if status == "" {
+		status = recipes.StatusPending
+	}
+	queue, err := recipes.GetModerationQueue(a.db(req), status, start, count)
+	if err != nil {
+		if err == recipes.ErrInvalidStatus {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		} else {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	respond(w, http.StatusOK, queue)
+}
+
+func (a *App) approveRecipeEndpoint(w http.ResponseWriter, req *http.Request) {
+	a.moderateRecipe(w, req, recipes.StatusApproved)
+}
+
+func (a *App) rejectRecipeEndpoint(w http.ResponseWriter, req *http.Request) {
+	a.moderateRecipe(w, req, recipes.StatusRejected)
+}
+
+func (a *App) moderateRecipe(w http.ResponseWriter, req *http.Request, status string) {
+	params := mux.Vars(req)
+	recipeID := params["id"]
+	r, err := recipes.SetRecipeStatus(recipeID, status, a.db(req))
+	if err != nil {
+		if gocb.IsKeyNotFoundError(err) {
+			respondWithError(w, http.StatusNotFound, err.Error())
+		} else {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	respond(w, http.StatusOK, r)
+}
+
+// pagination returns the requested page offset and size, limited to 10 per page
+func pagination(req *http.Request) (start, count int) {
+	count, _ = strconv.Atoi(req.FormValue("count"))
+	start, _ = strconv.Atoi(req.FormValue("start"))
+
+	if count > 10 || count < 1 {
+		count = 10
+	}
+	if start < 0 {
+		start = 0
+	}
+	return start, count
+}
+
+// db returns the bucket of the request's tenant, with its operations
+// traced within the request and logged with its ID
+func (a *App) db(req *http.Request) *recipes.Bucket {
+	s := a.tenant(req)
+	fields := logrus.Fields{"request_id": requestID(req)}
+	if s.id != "" {
+		fields["tenant"] = s.id
+	}
+	return s.bucket.WithContext(req.Context()).WithLogFields(fields)
+}
+
+// respondWithError responds with an error message, and the request's ID if it has one
 func respondWithError(w http.ResponseWriter, code int, message string) {
-	respondWithJSON(w, code, map[string]string{"error": message})
+	body := map[string]string{"error": message}
+	if id := w.Header().Get(requestIDHeader); id != "" {
+		body["request_id"] = id
+	}
+	respond(w, code, body)
 }
 
-func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
-	response, _ := json.Marshal(payload)
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+// respond encodes payload in the media type negotiated for the request,
+// JSON if there was none
+func respond(w http.ResponseWriter, code int, payload interface{}) {
+	c := jsonCodec
+	ctx := context.Background()
+	if cw, ok := w.(*codecWriter); ok {
+		c, ctx = cw.codec, cw.ctx
+	}
+	_, span := tracer.Start(ctx, "encode "+c.mediaTypes[0])
+	response, err := c.marshal(payload)
+	span.End()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", c.contentType)
 	w.WriteHeader(code)
 	w.Write(response)
 }
 
-// Initialize sets up the database connection, router, and routes for the app
+// Initialize sets up the router and routes for the app, and connects to
+// the database in the background, creating any missing index: until it is
+// connected and the indexes are built, the API responds with 503 Service
+// Unavailable.
 func (a *App) Initialize(user, password, dbname string) {
+	a.user, a.password, a.dbname = user, password, dbname
+	a.store.ready = make(chan struct{})
+	go a.connect(user, password, dbname)
 
-	cluster, err := gocb.Connect("couchbase://couchbase")
+	var err error
+	a.cards, err = loadCardTemplates(a.TemplateDir)
 	if err != nil {
-		log.Fatal("Failed to connect to couchbase: ", err)
+		logger.Fatal("Failed to load recipe card templates: ", err)
 	}
-	cluster.Authenticate(gocb.PasswordAuthenticator{
-		Username: user,
-		Password: password,
-	})
-	a.DB, err = cluster.OpenBucket(dbname, "")
-	if err != nil {
-		log.Fatal("Failed to get bucket from couchbase: ", err)
-	}
-	a.Manager = a.DB.Manager(user, password)
 
 	a.Router = mux.NewRouter()
+	a.Router.Use(traced, logRequests, measure)
+	a.Router.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	a.Router.HandleFunc("/healthz", a.healthzEndpoint).Methods("GET")
+	a.Router.HandleFunc("/readyz", a.readyzEndpoint).Methods("GET")
 
 	v1 := a.Router.PathPrefix("/v1").Subrouter()
+	v1.Use(a.requireStore, negotiate, a.selectTenant)
 
 	v1.HandleFunc("/recipes", a.getRecipesEndpoint).Methods("GET")
 	v1.HandleFunc("/recipes", a.createRecipeEndpoint).Methods("POST")
-	v1.HandleFunc("/recipes/{id:[0-9]+}", a.getRecipeEndpoint).Methods("GET")
+	v1.HandleFunc("/recipes:batch", a.batchRecipesEndpoint).Methods("POST")
+	v1.HandleFunc("/recipes/{id:[0-9]+}", a.getRecipeEndpoint).Methods("GET").Name("recipe")
 	v1.HandleFunc("/recipes/{id:[0-9]+}", a.modifyRecipeEndpoint).Methods("PUT")
 	v1.HandleFunc("/recipes/{id:[0-9]+}", a.modifyRecipeEndpoint).Methods("PATCH")
 	v1.HandleFunc("/recipes/{id:[0-9]+}", a.deleteRecipeEndpoint).Methods("DELETE")
 	v1.HandleFunc("/recipes/{recipe_id:[0-9]+}/rating", a.addRatingEndpoint).Methods("POST")
 	v1.HandleFunc("/recipes/search", a.searchRecipesEndpoint).Methods("POST")
+	v1.HandleFunc("/recipes/top", a.getTopRecipesEndpoint).Methods("GET")
+	v1.HandleFunc("/recipes/trending", a.getTrendingRecipesEndpoint).Methods("GET")
+	v1.HandleFunc("/recipes/new", a.getNewRecipesEndpoint).Methods("GET")
+	v1.HandleFunc("/recipes/suggest", a.suggestRecipesEndpoint).Methods("GET")
+	v1.HandleFunc("/stats", a.getStatsEndpoint).Methods("GET")
+	v1.HandleFunc("/import", a.importRecipesEndpoint).Methods("POST")
+	v1.HandleFunc("/export", a.exportRecipesEndpoint).Methods("GET").Name("export")
+
+	v1.HandleFunc("/searches", a.getSavedSearchesEndpoint).Methods("GET")
+	v1.HandleFunc("/searches", a.createSavedSearchEndpoint).Methods("POST")
+	v1.HandleFunc("/searches/{id:[0-9]+}", a.getSavedSearchEndpoint).Methods("GET")
+	v1.HandleFunc("/searches/{id:[0-9]+}", a.deleteSavedSearchEndpoint).Methods("DELETE")
+	v1.HandleFunc("/searches/{id:[0-9]+}/results", a.getSavedSearchResultsEndpoint).Methods("GET")
+
+	admin := v1.PathPrefix("/admin").Subrouter()
+	admin.Use(a.requireAdmin)
+
+	admin.HandleFunc("/moderation", a.getModerationQueueEndpoint).Methods("GET")
+	admin.HandleFunc("/moderation/{id:[0-9]+}/approve", a.approveRecipeEndpoint).Methods("POST")
+	admin.HandleFunc("/moderation/{id:[0-9]+}/reject", a.rejectRecipeEndpoint).Methods("POST")
+
+	if a.MultiTenant {
+		admin.HandleFunc("/tenants", a.getTenantsEndpoint).Methods("GET").Name("tenants")
+		admin.HandleFunc("/tenants", a.createTenantEndpoint).Methods("POST").Name("create_tenant")
+		admin.HandleFunc("/tenants/{tenant}", a.getTenantEndpoint).Methods("GET").Name("tenant")
+		admin.HandleFunc("/tenants/{tenant}", a.deleteTenantEndpoint).Methods("DELETE").Name("delete_tenant")
+	}
 }
 
 // Run starts the app and serves on the specified port
 func (a *App) Run(port string) {
-	log.Print("Now serving recipes ...")
-	log.Fatal(http.ListenAndServe(":"+port, a.Router))
+	if a.MultiTenant && len(a.TenantSecret) == 0 && a.AdminToken == "" {
+		logger.Fatal("Multi-tenancy needs a tenant token secret or an admin token: no request could name a tenant")
+	}
+	logger.WithField("port", port).Info("Now serving recipes ...")
+	logger.Fatal(http.ListenAndServe(":"+port, a.Router))
 }
@@ -0,0 +1,71 @@
+package application
+
+import (
+	// native packages
+	"net/http"
+	"strconv"
+	// local packages
+	"restful_couchbase/recipes"
+	// external packages
+	"gopkg.in/couchbase/gocb.v1"
+)
+
+// batchResult reports the outcome of a single batch operation
+type batchResult struct {
+	Index  int             `json:"index"`
+	Op     string          `json:"op"`
+	ID     string          `json:"id,omitempty"`
+	Status int             `json:"status"`
+	Error  string          `json:"error,omitempty"`
+	Recipe *recipes.Recipe `json:"recipe,omitempty"`
+}
+
+func (a *App) batchRecipesEndpoint(w http.ResponseWriter, req *http.Request) {
+	var ops []recipes.BatchOp
+	if !decodeBody(w, req, &ops) {
+		return
+	}
+	if len(ops) > recipes.MaxBatchSize {
+		respondWithError(w, http.StatusBadRequest, "A batch may contain at most "+strconv.Itoa(recipes.MaxBatchSize)+" operations")
+		return
+	}
+
+	for _, op := range ops {
+		if op.Op != recipes.OpDelete && op.Recipe != nil {
+			op.Recipe.Moderate(a.Blocklist)
+		}
+	}
+
+	results := []batchResult{}
+	for i, result := range recipes.ExecuteBatch(a.db(req), ops) {
+		br := batchResult{Index: i, Op: ops[i].Op, ID: result.ID, Recipe: result.Recipe}
+		switch {
+		case result.Err == nil && ops[i].Op == recipes.OpCreate:
+			br.Status = http.StatusCreated
+		case result.Err == nil:
+			br.Status = http.StatusOK
+			if ops[i].Op == recipes.OpDelete {
+				br.Recipe = nil
+			}
+		default:
+			br.Status = batchErrorStatus(result.Err)
+			br.Error = result.Err.Error()
+			br.Recipe = nil
+		}
+		results = append(results, br)
+	}
+	respond(w, http.StatusMultiStatus, results)
+}
+
+// batchErrorStatus returns the HTTP status for the failure of a batch operation
+func batchErrorStatus(err error) int {
+	switch {
+	case err == recipes.ErrInvalidRecipe, err == recipes.ErrInvalidBatchOp, err == recipes.ErrInvalidRecipeID:
+		return http.StatusBadRequest
+	case err == recipes.ErrDuplicateBatchID, gocb.IsKeyExistsError(err):
+		return http.StatusConflict
+	case gocb.IsKeyNotFoundError(err):
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
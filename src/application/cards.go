@@ -0,0 +1,154 @@
+package application
+
+import (
+	// native packages
+	"bytes"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Recipe cards are printable renderings of a single recipe, offered by
+// GET /v1/recipes/{id} as Markdown and HTML. The default templates may be
+// overridden by files of the same name in the template directory; they
+// are executed with a recipes.RecipeRated.
+const (
+	markdownCardFile = "recipe.md.tmpl"
+	htmlCardFile     = "recipe.html.tmpl"
+
+	maxStars = 5
+)
+
+const defaultMarkdownCard = `# {{markdown .Name}}
+{{if .Vegetarian}}
+**Vegetarian**
+{{end}}
+- **Prep time:** {{minutes .PrepTime}}
+- **Difficulty:** {{.Difficulty}}
+- **Rating:** {{stars .AvgRating}}{{if .RatingCount}} ({{printf "%.1f" .AvgRating}} from {{.RatingCount}} {{if eq .RatingCount 1}}rating{{else}}ratings{{end}}){{else}} (not yet rated){{end}}
+{{- if .Tags}}
+- **Tags:** {{markdown (join .Tags ", ")}}
+{{- end}}
+`
+
+const defaultHTMLCard = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Name}}</title>
+<style>
+body { font-family: Georgia, serif; max-width: 32em; margin: 2em auto; }
+.card { border: 1px solid #444; border-radius: 8px; padding: 1em 1.5em; }
+.badge { display: inline-block; background: #2e7d32; color: #fff; border-radius: 4px; padding: 0 0.5em; font-size: 0.8em; }
+.stars { color: #f9a825; letter-spacing: 0.1em; }
+dt { font-weight: bold; float: left; clear: left; width: 7em; }
+dd { margin-left: 7em; }
+@media print { .card { border: none; } }
+</style>
+</head>
+<body>
+<article class="card">
+<h1>{{.Name}}</h1>
+{{if .Vegetarian}}<p><span class="badge">Vegetarian</span></p>
+{{end -}}
+<dl>
+<dt>Prep time</dt><dd>{{minutes .PrepTime}}</dd>
+<dt>Difficulty</dt><dd>{{.Difficulty}}</dd>
+<dt>Rating</dt><dd><span class="stars" title="{{printf "%.1f" .AvgRating}}">{{stars .AvgRating}}</span>{{if .RatingCount}} {{printf "%.1f" .AvgRating}} from {{.RatingCount}} {{if eq .RatingCount 1}}rating{{else}}ratings{{end}}{{else}} not yet rated{{end}}</dd>
+{{if .Tags}}<dt>Tags</dt><dd>{{join .Tags ", "}}</dd>
+{{end -}}
+</dl>
+</article>
+</body>
+</html>
+`
+
+// A cardTemplate is either a text or an HTML template.
+type cardTemplate interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+var cardFuncs = map[string]interface{}{
+	"stars":    stars,
+	"minutes":  minutes,
+	"join":     strings.Join,
+	"markdown": escapeMarkdown,
+}
+
+// loadCardTemplates parses the recipe card templates by media type,
+// preferring any found in dir.
+func loadCardTemplates(dir string) (map[string]cardTemplate, error) {
+
+	markdownCard, err := cardSource(dir, markdownCardFile, defaultMarkdownCard)
+	if err != nil {
+		return nil, err
+	}
+	htmlCard, err := cardSource(dir, htmlCardFile, defaultHTMLCard)
+	if err != nil {
+		return nil, err
+	}
+
+	markdown, err := texttemplate.New(markdownCardFile).Funcs(cardFuncs).Parse(markdownCard)
+	if err != nil {
+		return nil, err
+	}
+	html, err := htmltemplate.New(htmlCardFile).Funcs(cardFuncs).Parse(htmlCard)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]cardTemplate{
+		"text/markdown": markdown,
+		"text/html":     html,
+	}, nil
+}
+
+func cardSource(dir, file, fallback string) (string, error) {
+	if dir == "" {
+		return fallback, nil
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, file))
+	if os.IsNotExist(err) {
+		return fallback, nil
+	}
+	return string(b), err
+}
+
+// renderCard executes a card template, so that nothing is written if it fails.
+func renderCard(t cardTemplate, data interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// stars renders an average rating as filled and empty stars, out of five.
+func stars(rating float32) string {
+	filled := int(math.Round(float64(rating)))
+	if filled < 0 {
+		filled = 0
+	} else if filled > maxStars {
+		filled = maxStars
+	}
+	return strings.Repeat("★", filled) + strings.Repeat("☆", maxStars-filled)
+}
+
+func minutes(preptime float32) string {
+	return strconv.FormatFloat(float64(preptime), 'f', -1, 32) + " min"
+}
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "[", `\[`, "]", `\]`,
+	"#", `\#`, "<", `\<`, ">", `\>`, "|", `\|`,
+)
+
+func escapeMarkdown(s string) string {
+	return markdownEscaper.Replace(s)
+}
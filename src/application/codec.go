@@ -0,0 +1,556 @@
+package application
+
+import (
+	// native packages
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	// external packages
+	"github.com/ghodss/yaml"
+	"github.com/gorilla/mux"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// A codec encodes responses and decodes requests in one media type.
+// Every codec works from the JSON form of a value, so field names are
+// the same whatever the media type.
+type codec struct {
+	contentType string
+	mediaTypes  []string
+	marshal     func(interface{}) ([]byte, error)
+	unmarshal   func([]byte, interface{}) error
+}
+
+var jsonCodec = &codec{
+	contentType: "application/json; charset=utf-8",
+	mediaTypes:  []string{"application/json"},
+	marshal:     json.Marshal,
+	unmarshal:   json.Unmarshal,
+}
+
+// codecs are in order of preference, for wildcard Accept headers
+var codecs = []*codec{
+	jsonCodec,
+	{
+		contentType: "application/xml; charset=utf-8",
+		mediaTypes:  []string{"application/xml", "text/xml"},
+		marshal:     marshalXML,
+		unmarshal:   unmarshalXML,
+	},
+	{
+		contentType: "application/yaml; charset=utf-8",
+		mediaTypes:  []string{"application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml"},
+		marshal:     yaml.Marshal,
+		unmarshal:   yaml.Unmarshal,
+	},
+	{
+		contentType: "application/msgpack",
+		mediaTypes:  []string{"application/msgpack", "application/x-msgpack", "application/vnd.msgpack"},
+		marshal:     marshalMsgpack,
+		unmarshal:   unmarshalMsgpack,
+	},
+}
+
+// ownRepresentations names the routes which choose their own response
+// format; for these an unacceptable Accept header falls back to JSON.
+var ownRepresentations = map[string]bool{
+	"export": true,
+}
+
+// routeMediaTypes lists, by route name, the media types other than those
+// of the codecs which a route renders itself. They are offered after the
+// codecs, and the handler finds which was chosen with negotiatedType.
+var routeMediaTypes = map[string][]string{
+	"recipe": {"application/ld+json", "text/html", "text/markdown"},
+}
+
+var errUnsupportedMediaType = errors.New("unsupported media type")
+
+// codecWriter carries the codec and media type negotiated for a response,
+// and the request's context, for tracing the encoding.
+type codecWriter struct {
+	http.ResponseWriter
+	codec     *codec
+	mediaType string
+	ctx       context.Context
+}
+
+// Flush implements http.Flusher, for streamed responses
+func (w *codecWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// negotiate picks the response media type from the Accept header,
+// responding 406 Not Acceptable if there is none.
+func negotiate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Vary", "Accept")
+		var name string
+		if route := mux.CurrentRoute(req); route != nil {
+			name = route.GetName()
+		}
+		offered := append(mediaTypes(), routeMediaTypes[name]...)
+		mediaType := acceptedType(req.Header.Get("Accept"), offered)
+		if mediaType == "" {
+			if !ownRepresentations[name] {
+				respondWithError(w, http.StatusNotAcceptable, "Not acceptable, supported types are "+strings.Join(offered, ", "))
+				return
+			}
+			mediaType = jsonCodec.mediaTypes[0]
+		}
+		// Errors are still encoded as JSON for types rendered by the route
+		c := jsonCodec
+		for _, candidate := range codecs {
+			for _, t := range candidate.mediaTypes {
+				if t == mediaType {
+					c = candidate
+				}
+			}
+		}
+		next.ServeHTTP(&codecWriter{ResponseWriter: w, codec: c, mediaType: mediaType, ctx: req.Context()}, req)
+	})
+}
+
+// negotiatedType returns the media type negotiated for a response.
+func negotiatedType(w http.ResponseWriter) string {
+	if cw, ok := w.(*codecWriter); ok {
+		return cw.mediaType
+	}
+	return jsonCodec.mediaTypes[0]
+}
+
+// acceptedType returns the most preferred of the offered media types in an
+// Accept header, or "" if none of them are acceptable. Where preferences
+// are equal the earlier offer wins. No header accepts the first offer.
+func acceptedType(accept string, offered []string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offered[0]
+	}
+
+	type acceptRange struct {
+		mediaType string
+		q         float64
+	}
+	var ranges []acceptRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(s, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			ranges = append(ranges, acceptRange{mediaType, q})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+
+	for _, r := range ranges {
+		for _, mediaType := range offered {
+			if r.mediaType == mediaType || r.mediaType == "*/*" ||
+				strings.HasSuffix(r.mediaType, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(r.mediaType, "*")) {
+				return mediaType
+			}
+		}
+	}
+	return ""
+}
+
+func mediaTypes() []string {
+	var types []string
+	for _, c := range codecs {
+		types = append(types, c.mediaTypes...)
+	}
+	return types
+}
+
+// decodeBody decodes a request body according to its Content-Type,
+// JSON if there is none. If it cannot, it responds 415 or 400 and
+// returns false.
+func decodeBody(w http.ResponseWriter, req *http.Request, v interface{}) bool {
+	defer req.Body.Close()
+	err := decode(req, v)
+	if err == errUnsupportedMediaType {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Unsupported media type, supported types are "+strings.Join(mediaTypes(), ", "))
+		return false
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return false
+	}
+	return true
+}
+
+func decode(req *http.Request, v interface{}) error {
+	c := jsonCodec
+	if contentType := req.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return errUnsupportedMediaType
+		}
+		c = nil
+		for _, candidate := range codecs {
+			for _, t := range candidate.mediaTypes {
+				if t == mediaType {
+					c = candidate
+				}
+			}
+		}
+		if c == nil {
+			return errUnsupportedMediaType
+		}
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	return c.unmarshal(body, v)
+}
+
+// jsonTree returns the JSON form of v as maps, slices and scalars.
+// Whole numbers are int64, so that they stay whole in binary formats.
+func jsonTree(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	var tree interface{}
+	if err := decoder.Decode(&tree); err != nil {
+		return nil, err
+	}
+	return normalize(tree), nil
+}
+
+// fromTree decodes a tree of maps, slices and scalars into v,
+// through JSON so that the json field tags apply.
+func fromTree(tree interface{}, v interface{}) error {
+	b, err := json.Marshal(normalize(tree))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// normalize converts numbers and map keys to forms both JSON and
+// MessagePack can encode.
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = normalize(e)
+		}
+		return v
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			if s, ok := k.(string); ok {
+				m[s] = normalize(e)
+			} else {
+				b, _ := json.Marshal(k)
+				m[string(b)] = normalize(e)
+			}
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = normalize(e)
+		}
+		return v
+	}
+	return v
+}
+
+func marshalMsgpack(v interface{}) ([]byte, error) {
+	tree, err := jsonTree(v)
+	if err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(tree)
+}
+
+func unmarshalMsgpack(data []byte, v interface{}) error {
+	var tree interface{}
+	if err := msgpack.Unmarshal(data, &tree); err != nil {
+		return err
+	}
+	return fromTree(tree, v)
+}
+
+// XML has no maps or lists of its own: objects become elements named
+// after their keys (or <entry key="..."> where a key is not a valid
+// element name), and lists become repeated <item> elements, all inside
+// a <response> element. When decoding, element text is only taken as a
+// number or a boolean where the value decoded into has one, so that a
+// recipe named "1984" stays a string.
+
+const (
+	xmlRoot  = "response"
+	xmlItem  = "item"
+	xmlEntry = "entry"
+)
+
+func marshalXML(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	encoder := xml.NewEncoder(&buf)
+	if err := writeXML(encoder, decoder, xml.StartElement{Name: xml.Name{Local: xmlRoot}}); err != nil {
+		return nil, err
+	}
+	if err := encoder.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeXML copies the next JSON value from decoder to encoder as the element start.
+func writeXML(encoder *xml.Encoder, decoder *json.Decoder, start xml.StartElement) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if err := encoder.EncodeToken(start); err != nil {
+		return err
+	}
+	switch token := token.(type) {
+	case json.Delim:
+		isObject := token == '{'
+		for decoder.More() {
+			child := xml.StartElement{Name: xml.Name{Local: xmlItem}}
+			if isObject {
+				key, err := decoder.Token()
+				if err != nil {
+					return err
+				}
+				child = xmlElement(key.(string))
+			}
+			if err := writeXML(encoder, decoder, child); err != nil {
+				return err
+			}
+		}
+		// The closing delimiter
+		if _, err := decoder.Token(); err != nil {
+			return err
+		}
+	case string:
+		err = encoder.EncodeToken(xml.CharData(token))
+	case json.Number:
+		err = encoder.EncodeToken(xml.CharData(token.String()))
+	case bool:
+		err = encoder.EncodeToken(xml.CharData(strconv.FormatBool(token)))
+	}
+	if err != nil {
+		return err
+	}
+	return encoder.EncodeToken(start.End())
+}
+
+func xmlElement(key string) xml.StartElement {
+	if validXMLName(key) {
+		return xml.StartElement{Name: xml.Name{Local: key}}
+	}
+	return xml.StartElement{
+		Name: xml.Name{Local: xmlEntry},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: key}},
+	}
+}
+
+func validXMLName(name string) bool {
+	if name == "" || strings.HasPrefix(strings.ToLower(name), "xml") {
+		return false
+	}
+	for i, c := range name {
+		letter := c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+		if !letter && (i == 0 || c != '-' && c != '.' && (c < '0' || c > '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+func unmarshalXML(data []byte, v interface{}) error {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		if _, ok := token.(xml.StartElement); ok {
+			tree, err := readXML(decoder)
+			if err != nil {
+				return err
+			}
+			return fromTree(coerceXML(tree, reflect.TypeOf(v)), v)
+		}
+	}
+}
+
+// readXML reads the content of the element just started, up to its end.
+func readXML(decoder *xml.Decoder) (interface{}, error) {
+	type child struct {
+		key   string
+		value interface{}
+	}
+	var children []child
+	var text strings.Builder
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			key := token.Name.Local
+			for _, attr := range token.Attr {
+				if key == xmlEntry && attr.Name.Local == "key" {
+					key = attr.Value
+				}
+			}
+			value, err := readXML(decoder)
+			if err != nil {
+				return nil, err
+			}
+			children = append(children, child{key, value})
+		case xml.CharData:
+			text.Write(token)
+		case xml.EndElement:
+			if len(children) == 0 {
+				if text := strings.TrimSpace(text.String()); text != "" {
+					return text, nil
+				}
+				return nil, nil
+			}
+			items := true
+			for _, c := range children {
+				items = items && c.key == xmlItem
+			}
+			if items {
+				list := make([]interface{}, len(children))
+				for i, c := range children {
+					list[i] = c.value
+				}
+				return list, nil
+			}
+			object := make(map[string]interface{})
+			for _, c := range children {
+				// Repeated elements make a list
+				if existing, ok := object[c.key]; ok {
+					if list, ok := existing.([]interface{}); ok {
+						object[c.key] = append(list, c.value)
+					} else {
+						object[c.key] = []interface{}{existing, c.value}
+					}
+					continue
+				}
+				object[c.key] = c.value
+			}
+			return object, nil
+		}
+	}
+}
+
+// coerceXML converts the text of an XML tree to numbers and booleans
+// wherever the JSON form of type t has them.
+func coerceXML(tree interface{}, t reflect.Type) interface{} {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil {
+		return tree
+	}
+	switch tree := tree.(type) {
+	case string:
+		switch t.Kind() {
+		case reflect.Bool:
+			if b, err := strconv.ParseBool(tree); err == nil {
+				return b
+			}
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			if _, err := strconv.ParseFloat(tree, 64); err == nil && json.Valid([]byte(tree)) {
+				return json.Number(tree)
+			}
+		}
+	case []interface{}:
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			for i, e := range tree {
+				tree[i] = coerceXML(e, t.Elem())
+			}
+		}
+	case map[string]interface{}:
+		for k, e := range tree {
+			switch t.Kind() {
+			case reflect.Map:
+				tree[k] = coerceXML(e, t.Elem())
+			case reflect.Struct:
+				if f, ok := jsonField(t, k); ok {
+					tree[k] = coerceXML(e, f.Type)
+				}
+			}
+		}
+	}
+	return tree
+}
+
+// jsonField finds the field of struct type t which has the JSON name,
+// including the fields of embedded structs.
+func jsonField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")[0]
+		if tag == "-" {
+			continue
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && tag == "" && ft.Kind() == reflect.Struct {
+			if embedded, ok := jsonField(ft, name); ok {
+				return embedded, true
+			}
+			continue
+		}
+		if tag == "" {
+			tag = f.Name
+		}
+		if strings.EqualFold(tag, name) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
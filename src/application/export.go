@@ -0,0 +1,41 @@
+package application
+
+import (
+	// native packages
+	"net/http"
+	// local packages
+	"restful_couchbase/recipes"
+)
+
+// exportContentTypes maps export formats onto their content types
+var exportContentTypes = map[string]string{
+	recipes.FormatJSONL: "application/x-ndjson; charset=utf-8",
+	recipes.FormatCSV:   "text/csv; charset=utf-8",
+	recipes.FormatJSON:  "application/json; charset=utf-8",
+}
+
+// exportRecipesEndpoint streams every recipe as JSON Lines (the default), CSV or JSON.
+func (a *App) exportRecipesEndpoint(w http.ResponseWriter, req *http.Request) {
+	format := req.FormValue("format")
+	if format == "" {
+		format = recipes.FormatJSONL
+	}
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, recipes.ErrUnknownFormat.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="recipes.`+format+`"`)
+	w.WriteHeader(http.StatusOK)
+
+	var flush func()
+	if flusher, ok := w.(http.Flusher); ok {
+		flush = flusher.Flush
+	}
+	// Once streaming has started, all that can be done is to cut the export short
+	if err := recipes.ExportRecipes(a.db(req), w, format, flush); err != nil {
+		logger.WithField("request_id", requestID(req)).WithError(err).Error("Export failed")
+	}
+}
@@ -0,0 +1,37 @@
+package application
+
+import (
+	// native packages
+	"net/http"
+	// local packages
+	"restful_couchbase/recipes"
+)
+
+// The readiness entity reports whether the app can serve requests, and why not
+type readiness struct {
+	Status string                         `json:"status"`
+	Checks map[string]recipes.CheckResult `json:"checks"`
+}
+
+// healthzEndpoint reports that the process is alive, whatever the state of Couchbase
+func (a *App) healthzEndpoint(w http.ResponseWriter, req *http.Request) {
+	respond(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyzEndpoint reports whether Couchbase is ready, with the detail of each check
+func (a *App) readyzEndpoint(w http.ResponseWriter, req *http.Request) {
+	if !a.store.isReady() {
+		respond(w, http.StatusServiceUnavailable, readiness{Status: "unavailable", Checks: map[string]recipes.CheckResult{
+			"connection": {Status: recipes.CheckFail, Error: a.store.status().Error()},
+		}})
+		return
+	}
+	checks := recipes.CheckReadiness(a.db(req))
+	result, code := readiness{Status: "ready", Checks: checks}, http.StatusOK
+	for _, check := range checks {
+		if !check.OK() {
+			result.Status, code = "unavailable", http.StatusServiceUnavailable
+		}
+	}
+	respond(w, code, result)
+}
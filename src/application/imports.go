@@ -0,0 +1,54 @@
+package application
+
+import (
+	// native packages
+	"mime"
+	"net/http"
+	"strconv"
+	// local packages
+	"restful_couchbase/recipes"
+)
+
+// importFormats maps upload content types onto import formats
+var importFormats = map[string]string{
+	"text/csv":             recipes.FormatCSV,
+	"application/x-ndjson": recipes.FormatJSONL,
+	"application/jsonl":    recipes.FormatJSONL,
+}
+
+// importRecipesEndpoint streams an uploaded JSON Lines or CSV file into the store.
+// Options are taken from the query string, as the body is the file itself.
+func (a *App) importRecipesEndpoint(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	defer req.Body.Close()
+
+	format := query.Get("format")
+	if format == "" {
+		mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		format = importFormats[mediaType]
+	}
+	columns, err := recipes.ParseColumnMap(query.Get("map"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	dryRun, _ := strconv.ParseBool(query.Get("dry_run"))
+	fromLine, _ := strconv.Atoi(query.Get("resume"))
+
+	report, err := recipes.ImportRecipes(a.db(req), req.Body, recipes.ImportOptions{
+		Format:    format,
+		Columns:   columns,
+		DryRun:    dryRun,
+		FromLine:  fromLine,
+		Blocklist: a.Blocklist,
+	})
+	if err != nil {
+		if report == nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		} else {
+			respond(w, http.StatusInternalServerError, report)
+		}
+		return
+	}
+	respond(w, http.StatusOK, report)
+}
@@ -0,0 +1,42 @@
+package application
+
+import (
+	// native packages
+	"encoding/json"
+	"mime"
+	"net/http"
+	// local packages
+	"restful_couchbase/recipes"
+)
+
+// ldJSON is the media type of schema.org recipes in JSON-LD
+const ldJSON = "application/ld+json"
+
+// decodeRecipe decodes a recipe from a request body, which may also be
+// a schema.org Recipe in JSON-LD. If it cannot, it responds and returns false.
+func decodeRecipe(w http.ResponseWriter, req *http.Request, r *recipes.Recipe) bool {
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType != ldJSON {
+		return decodeBody(w, req, r)
+	}
+	defer req.Body.Close()
+	var doc recipes.JSONLDRecipe
+	if err := json.NewDecoder(req.Body).Decode(&doc); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return false
+	}
+	recipe, err := doc.Recipe()
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+	*r = recipe
+	return true
+}
+
+// respondWithJSONLD responds with a recipe as a schema.org Recipe
+func respondWithJSONLD(w http.ResponseWriter, code int, r recipes.RecipeRated) {
+	response, _ := json.Marshal(r.JSONLD())
+	w.Header().Set("Content-Type", ldJSON+"; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(response)
+}
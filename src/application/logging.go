@@ -0,0 +1,137 @@
+package application
+
+import (
+	// native packages
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	// local packages
+	"restful_couchbase/recipes"
+	// external packages
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// requestIDHeader carries the ID of a request, which is echoed in its response
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength limits the length of a propagated request ID
+const maxRequestIDLength = 128
+
+// logger writes the access log and the app's own messages as JSON
+var logger = logrus.New()
+
+type requestIDKey struct{}
+
+// ConfigureLogging sets the app's log level, and the level of the
+// database-layer diagnostics, which defaults to the app's. Levels are
+// logrus level names (debug, info, warn, error); the default is info.
+func ConfigureLogging(level, dbLevel string) error {
+	appLevel, err := parseLevel(level)
+	if err != nil {
+		return err
+	}
+	if dbLevel == "" {
+		dbLevel = level
+	}
+	recipesLevel, err := parseLevel(dbLevel)
+	if err != nil {
+		return err
+	}
+	logger.SetLevel(appLevel)
+	recipes.Log.SetLevel(recipesLevel)
+	return nil
+}
+
+func parseLevel(level string) (logrus.Level, error) {
+	if level == "" {
+		return logrus.InfoLevel, nil
+	}
+	return logrus.ParseLevel(level)
+}
+
+func init() {
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	recipes.Log.SetFormatter(&logrus.JSONFormatter{})
+}
+
+// logRequests gives each request an ID, propagated from its X-Request-ID
+// header if it has one, and writes an access log entry once it is served.
+// It runs within the request's span, so entries carry the trace ID.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		id := req.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		trace.SpanFromContext(req.Context()).SetAttributes(attribute.String("http.request_id", id))
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		req = req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id))
+		next.ServeHTTP(sw, req)
+
+		fields := logrus.Fields{
+			"request_id": id,
+			"method":     req.Method,
+			"route":      routeTemplate(req),
+			"path":       req.URL.Path,
+			"status":     sw.status,
+			"bytes":      sw.bytes,
+			"latency_ms": float64(time.Since(start).Microseconds()) / 1000,
+			"client_ip":  clientIP(req),
+			"user_agent": req.UserAgent(),
+		}
+		if span := trace.SpanContextFromContext(req.Context()); span.IsValid() {
+			fields["trace_id"] = span.TraceID().String()
+		}
+		level := logrus.InfoLevel
+		if sw.status >= http.StatusInternalServerError {
+			level = logrus.ErrorLevel
+		}
+		logger.WithFields(fields).Log(level, "request")
+	})
+}
+
+// requestID returns the ID given to a request by logRequests
+func requestID(req *http.Request) string {
+	id, _ := req.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// clientIP returns the address of the client, or of the first proxy to forward the request
+func clientIP(req *http.Request) string {
+	if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,147 @@
+package application
+
+import (
+	// native packages
+	"net/http"
+	"time"
+	// local packages
+	"restful_couchbase/recipes"
+	// external packages
+	"github.com/gorilla/mux"
+	"gopkg.in/couchbase/gocb.v1"
+)
+
+// savedSearchLimit is the number of matches tracked for new-match detection
+const savedSearchLimit = 100
+
+// savedSearchResults is the response to a re-run of a saved search
+type savedSearchResults struct {
+	Search      recipes.SavedSearch   `json:"search"`
+	Results     []recipes.RecipeRated `json:"results"`
+	New         []string              `json:"new"`
+	NewCount    int                   `json:"new_count"`
+	PreviousRun *time.Time            `json:"previous_run"`
+}
+
+func (a *App) createSavedSearchEndpoint(w http.ResponseWriter, req *http.Request) {
+	var s recipes.SavedSearch
+	if !decodeBody(w, req, &s) {
+		return
+	}
+	if err := s.CreateSavedSearch(a.db(req)); err != nil {
+		if err == recipes.ErrInvalidSavedSearch {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		} else {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	respond(w, http.StatusCreated, s)
+}
+
+func (a *App) getSavedSearchesEndpoint(w http.ResponseWriter, req *http.Request) {
+	start, count := pagination(req)
+	user := req.FormValue("user")
+	if user == "" {
+		respondWithError(w, http.StatusBadRequest, "Missing user")
+		return
+	}
+	searches, err := recipes.GetSavedSearches(a.db(req), user, start, count)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respond(w, http.StatusOK, searches)
+}
+
+func (a *App) getSavedSearchEndpoint(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	searchID := params["id"]
+	s := recipes.SavedSearch{}
+	if err := s.GetSavedSearch(searchID, a.db(req)); err != nil {
+		if gocb.IsKeyNotFoundError(err) {
+			respondWithError(w, http.StatusNotFound, err.Error())
+		} else {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	respond(w, http.StatusOK, s)
+}
+
+func (a *App) deleteSavedSearchEndpoint(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	searchID := params["id"]
+	s := recipes.SavedSearch{}
+	if err := s.DeleteSavedSearch(searchID, a.db(req)); err != nil {
+		if gocb.IsKeyNotFoundError(err) {
+			respondWithError(w, http.StatusNotFound, err.Error())
+		} else {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	respond(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// getSavedSearchResultsEndpoint re-runs a saved search. The first matches
+// by ID (up to savedSearchLimit) are compared with those of the previous
+// run, so that clients can show how many are new.
+func (a *App) getSavedSearchResultsEndpoint(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	searchID := params["id"]
+	start, count := pagination(req)
+
+	s := recipes.SavedSearch{}
+	if err := s.GetSavedSearch(searchID, a.db(req)); err != nil {
+		if gocb.IsKeyNotFoundError(err) {
+			respondWithError(w, http.StatusNotFound, err.Error())
+		} else {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	recipesRated, _, err := a.searchRecipes(req, s.Filter, start, count, false)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	matched, err := a.savedSearchMatches(req, s.Filter)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	previousRun := s.LastRun
+	newIDs, err := s.RecordRun(searchID, matched, a.db(req))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusOK, savedSearchResults{
+		Search:      s,
+		Results:     recipesRated,
+		New:         newIDs,
+		NewCount:    len(newIDs),
+		PreviousRun: previousRun,
+	})
+}
+
+// savedSearchMatches returns the IDs tracked for new-match detection
+func (a *App) savedSearchMatches(req *http.Request, filter recipes.SearchFilter) ([]string, error) {
+	db := a.db(req)
+	var ids []string
+	if filter.Query != "" {
+		matches, err := a.tenant(req).text.Match(db, filter.Query, filter.PrepTime)
+		if err != nil {
+			return nil, err
+		}
+		ids = []string{}
+		for _, m := range matches {
+			ids = append(ids, m.ID)
+		}
+	}
+	return recipes.MatchingRecipeIDs(db, filter, ids, savedSearchLimit)
+}
@@ -0,0 +1,39 @@
+package application
+
+import (
+	// native packages
+	"net/http"
+	"sync"
+	"time"
+	// local packages
+	"restful_couchbase/recipes"
+)
+
+// statsTTL is how long statistics are served from cache before being recomputed
+const statsTTL = 30 * time.Second
+
+// statsCache protects the query service from repeated statistics requests
+type statsCache struct {
+	sync.Mutex
+	stats   *recipes.Stats
+	expires time.Time
+}
+
+func (a *App) getStatsEndpoint(w http.ResponseWriter, req *http.Request) {
+	cache := &a.tenant(req).stats
+
+	// Holding the lock while recomputing means concurrent requests share the result
+	cache.Lock()
+	defer cache.Unlock()
+
+	if cache.stats == nil || time.Now().After(cache.expires) {
+		stats, err := recipes.GetStats(a.db(req))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		cache.stats = stats
+		cache.expires = time.Now().Add(statsTTL)
+	}
+	respond(w, http.StatusOK, cache.stats)
+}
@@ -0,0 +1,160 @@
+package application
+
+import (
+	// native packages
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+	// local packages
+	"restful_couchbase/recipes"
+	// external packages
+	"github.com/sirupsen/logrus"
+	"gopkg.in/couchbase/gocb.v1"
+)
+
+// Connecting to Couchbase is retried with exponential backoff: the delay
+// doubles after each failed attempt, up to maxConnectDelay, and the app
+// gives up after ConnectAttempts attempts.
+const (
+	defaultConnectAttempts = 10
+	initialConnectDelay    = 500 * time.Millisecond
+	maxConnectDelay        = 30 * time.Second
+)
+
+// ErrStoreNotReady is returned while Couchbase has not been connected to
+var ErrStoreNotReady = errors.New("the recipe store is not available yet")
+
+// storeState tracks the connection to Couchbase. ready is closed once
+// the app's DB and Manager are set, so they may be read without locking
+// by whoever has seen it closed.
+type storeState struct {
+	ready chan struct{}
+
+	mu       sync.Mutex
+	attempts int
+	err      error
+}
+
+func (s *storeState) isReady() bool {
+	select {
+	case <-s.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *storeState) failed(attempt int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts, s.err = attempt, err
+}
+
+// status describes why the store is not ready yet
+func (s *storeState) status() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		return ErrStoreNotReady
+	}
+	return fmt.Errorf("%s: attempt %d failed: %s", ErrStoreNotReady, s.attempts, s.err)
+}
+
+// connect opens the bucket, retrying with backoff, and marks the store ready
+func (a *App) connect(user, password, dbname string) {
+	attempts := a.ConnectAttempts
+	if attempts <= 0 {
+		attempts = defaultConnectAttempts
+	}
+
+	delay := initialConnectDelay
+	for attempt := 1; ; attempt++ {
+		cluster, bucket, err := openBucket(user, password, dbname)
+		if err == nil {
+			a.cluster = cluster
+			a.DB = recipes.NewBucket(bucket)
+			a.Manager = a.DB.Manager(user, password)
+			if !a.SkipIndexes {
+				if err := recipes.EnsureIndexes(a.Manager); err != nil {
+					logger.WithError(err).Fatal("Failed to provision couchbase indexes")
+				}
+			}
+			a.defaultStore = a.newTenantStore("", a.DB, a.SearchIndex)
+			close(a.store.ready)
+			logger.WithField("attempts", attempt).Info("Connected to couchbase")
+			if a.MigrateOnStart {
+				go a.migrate()
+			}
+			return
+		}
+
+		a.store.failed(attempt, err)
+		entry := logger.WithError(err).WithFields(logrus.Fields{"attempt": attempt, "max_attempts": attempts})
+		if attempt == attempts {
+			entry.Fatal("Failed to connect to couchbase, giving up")
+		}
+		entry.WithField("retry_in", delay.String()).Warn("Failed to connect to couchbase, retrying")
+
+		time.Sleep(delay)
+		if delay *= 2; delay > maxConnectDelay {
+			delay = maxConnectDelay
+		}
+	}
+}
+
+// migrate upgrades the recipes stored by an earlier version. Recipes are
+// upgraded as they are read until then, so the app is ready meanwhile,
+// and a failed migration is left for the next start or the migrate command.
+func (a *App) migrate() {
+	report, err := recipes.MigrateRecipes(a.DB, nil)
+	if err != nil {
+		logger.WithError(err).Error("Failed to migrate recipes")
+		return
+	}
+	entry := logger.WithFields(logrus.Fields{"version": report.Version, "scanned": report.Scanned, "migrated": report.Migrated})
+	if report.Failed > 0 || report.Conflicts > 0 {
+		entry.WithFields(logrus.Fields{"failed": report.Failed, "conflicts": report.Conflicts}).Warn("Some recipes were not migrated")
+	} else if report.Scanned > 0 {
+		entry.Info("Migrated recipes")
+	}
+}
+
+func openBucket(user, password, dbname string) (*gocb.Cluster, *gocb.Bucket, error) {
+	cluster, err := gocb.Connect("couchbase://couchbase")
+	if err != nil {
+		return nil, nil, err
+	}
+	cluster.Authenticate(gocb.PasswordAuthenticator{
+		Username: user,
+		Password: password,
+	})
+	bucket, err := cluster.OpenBucket(dbname, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	return cluster, bucket, nil
+}
+
+// WaitReady blocks until the app is connected to Couchbase, or the timeout expires
+func (a *App) WaitReady(timeout time.Duration) error {
+	select {
+	case <-a.store.ready:
+		return nil
+	case <-time.After(timeout):
+		return a.store.status()
+	}
+}
+
+// requireStore responds with 503 Service Unavailable until the app is connected to Couchbase
+func (a *App) requireStore(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !a.store.isReady() {
+			w.Header().Set("Retry-After", "1")
+			respondWithError(w, http.StatusServiceUnavailable, ErrStoreNotReady.Error())
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
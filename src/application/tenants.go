@@ -0,0 +1,513 @@
+package application
+
+import (
+	// native packages
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	// local packages
+	"restful_couchbase/recipes"
+	// external packages
+	"github.com/gorilla/mux"
+	"gopkg.in/couchbase/gocb.v1"
+)
+
+// Multi-tenancy: each tenant's recipes, searches and ID counters are kept
+// in a bucket of their own, named after the default bucket and the tenant.
+// The tenant of a request is named by the tenant claim of a bearer token.
+// Anyone may send a header or use a host, so only requests which carry the
+// admin token may name it with the X-Tenant-ID header, or the host of one
+// of its registered hosts, instead. The default bucket holds the tenants
+// themselves, which are provisioned through the admin API.
+const (
+	tenantHeader = "X-Tenant-ID"
+
+	// tenantsTTL is how long the hosts of the tenants are used before being reloaded
+	tenantsTTL = time.Minute
+
+	// defaultTenantBucketQuota is the memory quota of a tenant's bucket, in MB
+	defaultTenantBucketQuota = 100
+
+	// tenantBucketAttempts bounds the attempts to open a new bucket, which
+	// is not usable as soon as it is created
+	tenantBucketAttempts = 8
+)
+
+// Tenant resolution errors.
+var (
+	errNoTenant      = errors.New("no tenant: use a tenant token, the " + tenantHeader + " header or a tenant's host")
+	errUnknownTenant = errors.New("unknown tenant")
+	errInvalidToken  = errors.New("invalid or expired tenant token")
+	errTokenRequired = errors.New("a tenant token is required")
+	errNotTenanted   = errors.New("the app is not multi-tenant")
+	errTenantClash   = errors.New("the " + tenantHeader + " header names another tenant than the token")
+	errTenantExists  = errors.New("the tenant, or one of its hosts, already exists")
+)
+
+// tenantlessRoutes are served from the default bucket whatever the tenant.
+var tenantlessRoutes = map[string]bool{
+	"tenants":       true,
+	"create_tenant": true,
+	"tenant":        true,
+	"delete_tenant": true,
+}
+
+// A tenantStore is the bucket of a tenant, with the caches built from it.
+// Requests hold mu for reading while they use the bucket, so that removing
+// the tenant waits for them before closing it.
+type tenantStore struct {
+	id     string
+	bucket *recipes.Bucket
+	stats  statsCache
+	text   recipes.TextSearcher
+	names  *recipes.NameTrie
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// tenantRegistry holds the stores of the tenants opened so far, and the
+// tenant of each host.
+type tenantRegistry struct {
+	sync.Mutex
+	stores  map[string]*tenantStore
+	hosts   map[string]string
+	expires time.Time
+}
+
+type tenantKey struct{}
+
+// newTenantStore wraps a bucket; an FTS index is only used if named.
+func (a *App) newTenantStore(id string, bucket *recipes.Bucket, searchIndex string) *tenantStore {
+	s := &tenantStore{id: id, bucket: bucket, names: recipes.NewNameTrie(nameTrieTTL, a.RatingPrior)}
+	if searchIndex != "" {
+		s.text = recipes.FTSSearcher{Index: searchIndex}
+	} else {
+		s.text = recipes.NewTextIndex(textIndexTTL)
+	}
+	return s
+}
+
+// acquire reports whether the store is still open, in which case it must
+// be released once the bucket is no longer used.
+func (s *tenantStore) acquire() bool {
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return false
+	}
+	return true
+}
+
+func (s *tenantStore) release() {
+	s.mu.RUnlock()
+}
+
+// close waits for the requests using the store, and closes its bucket.
+func (s *tenantStore) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed && s.bucket != nil {
+		s.bucket.Close()
+	}
+	s.closed = true
+}
+
+// tenant returns the store of the request's tenant, the default store if
+// the app is not multi-tenant.
+func (a *App) tenant(req *http.Request) *tenantStore {
+	if s, ok := req.Context().Value(tenantKey{}).(*tenantStore); ok {
+		return s
+	}
+	return a.defaultStore
+}
+
+// selectTenant finds the store of the request's tenant, responding with an
+// error if there is none.
+func (a *App) selectTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if route := mux.CurrentRoute(req); !a.MultiTenant || route != nil && tenantlessRoutes[route.GetName()] {
+			next.ServeHTTP(w, req)
+			return
+		}
+		s, err := a.resolveTenant(req)
+		if err == nil && !s.acquire() {
+			// Removed since it was looked up
+			err = errUnknownTenant
+		}
+		switch err {
+		case nil:
+			defer s.release()
+			next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), tenantKey{}, s)))
+		case errNoTenant:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		case errInvalidToken, errTokenRequired:
+			respondWithError(w, http.StatusUnauthorized, err.Error())
+		case errTenantClash:
+			respondWithError(w, http.StatusForbidden, err.Error())
+		case errUnknownTenant:
+			respondWithError(w, http.StatusNotFound, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+	})
+}
+
+func (a *App) resolveTenant(req *http.Request) (*tenantStore, error) {
+	id := req.Header.Get(tenantHeader)
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		claimed, err := verifyTenantToken(strings.TrimPrefix(auth, "Bearer "), a.TenantSecret)
+		if err != nil {
+			return nil, err
+		}
+		if id != "" && id != claimed {
+			return nil, errTenantClash
+		}
+		id = claimed
+	} else if !a.isAdmin(req) {
+		return nil, errTokenRequired
+	}
+	if id == "" {
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			host = req.Host
+		}
+		if id, err = a.tenantForHost(strings.ToLower(host)); err != nil {
+			return nil, err
+		}
+	}
+	if id == "" {
+		return nil, errNoTenant
+	}
+	return a.openTenant(id)
+}
+
+// tenantForHost returns the tenant registered for a host, if any.
+func (a *App) tenantForHost(host string) (string, error) {
+	a.tenants.Lock()
+	defer a.tenants.Unlock()
+
+	if a.tenants.hosts == nil || time.Now().After(a.tenants.expires) {
+		tenants, err := recipes.GetTenants(a.DB)
+		if err != nil {
+			return "", err
+		}
+		a.tenants.hosts = make(map[string]string)
+		for _, t := range tenants {
+			for _, h := range t.Hosts {
+				a.tenants.hosts[h] = t.ID
+			}
+		}
+		a.tenants.expires = time.Now().Add(tenantsTTL)
+	}
+	return a.tenants.hosts[host], nil
+}
+
+// openTenant returns the store of a tenant, opening its bucket the first
+// time. The registry is not locked while the bucket is opened, so that the
+// requests of other tenants are not held up; if the bucket of the tenant is
+// opened twice meanwhile, the first one kept wins.
+func (a *App) openTenant(id string) (*tenantStore, error) {
+	a.tenants.Lock()
+	s, ok := a.tenants.stores[id]
+	a.tenants.Unlock()
+	if ok {
+		return s, nil
+	}
+
+	if !recipes.ValidTenantID(id) {
+		return nil, errUnknownTenant
+	}
+	var t recipes.Tenant
+	if err := t.GetTenant(id, a.DB); err != nil {
+		if gocb.IsKeyNotFoundError(err) {
+			return nil, errUnknownTenant
+		}
+		return nil, err
+	}
+	bucket, err := a.cluster.OpenBucket(t.Bucket, "")
+	if err != nil {
+		return nil, err
+	}
+
+	a.tenants.Lock()
+	defer a.tenants.Unlock()
+	if s, ok := a.tenants.stores[id]; ok {
+		bucket.Close()
+		return s, nil
+	}
+	return a.addTenant(&t, recipes.NewBucket(bucket)), nil
+}
+
+// TenantBucket returns the bucket of a tenant, or the default bucket if id
+// is empty. The app must be ready.
+func (a *App) TenantBucket(id string) (*recipes.Bucket, error) {
+	if id == "" {
+		return a.DB, nil
+	}
+	if !a.MultiTenant {
+		return nil, errNotTenanted
+	}
+	s, err := a.openTenant(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.bucket, nil
+}
+
+// addTenant caches the store of a tenant; the registry must be locked.
+func (a *App) addTenant(t *recipes.Tenant, bucket *recipes.Bucket) *tenantStore {
+	if a.tenants.stores == nil {
+		a.tenants.stores = make(map[string]*tenantStore)
+	}
+	s := a.newTenantStore(t.ID, bucket, t.SearchIndex)
+	a.tenants.stores[t.ID] = s
+	return s
+}
+
+// provisionTenant creates a tenant's bucket, unless it exists already,
+// creates its indexes and registers the tenant.
+func (a *App) provisionTenant(t *recipes.Tenant) error {
+	if !recipes.ValidTenantID(t.ID) {
+		return recipes.ErrInvalidTenant
+	}
+	for i, host := range t.Hosts {
+		t.Hosts[i] = strings.ToLower(host)
+		if owner, err := a.tenantForHost(t.Hosts[i]); err != nil {
+			return err
+		} else if owner != "" {
+			return errTenantExists
+		}
+	}
+	var existing recipes.Tenant
+	if err := existing.GetTenant(t.ID, a.DB); err == nil {
+		return errTenantExists
+	} else if !gocb.IsKeyNotFoundError(err) {
+		return err
+	}
+
+	t.Bucket = a.dbname + "-" + t.ID
+	cm := a.cluster.Manager(a.user, a.password)
+	buckets, err := cm.GetBuckets()
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, b := range buckets {
+		found = found || b.Name == t.Bucket
+	}
+	if !found {
+		quota := a.TenantBucketQuota
+		if quota <= 0 {
+			quota = defaultTenantBucketQuota
+		}
+		settings := &gocb.BucketSettings{Name: t.Bucket, Type: gocb.Couchbase, Quota: quota, FlushEnabled: true}
+		if err := cm.InsertBucket(settings); err != nil {
+			return err
+		}
+	}
+
+	bucket, err := a.openNewBucket(t.Bucket)
+	if err != nil {
+		return err
+	}
+	db := recipes.NewBucket(bucket)
+	if !a.SkipIndexes {
+		if err := recipes.EnsureIndexes(db.Manager(a.user, a.password)); err != nil {
+			return err
+		}
+	}
+	if err := t.CreateTenant(a.DB); err != nil {
+		if gocb.IsKeyExistsError(err) {
+			return errTenantExists
+		}
+		return err
+	}
+
+	a.tenants.Lock()
+	defer a.tenants.Unlock()
+	a.addTenant(t, db)
+	// Pick up the new hosts
+	a.tenants.hosts = nil
+	return nil
+}
+
+// openNewBucket opens a bucket which was just created, retrying with
+// backoff until the cluster has made it available.
+func (a *App) openNewBucket(name string) (*gocb.Bucket, error) {
+	delay := initialConnectDelay
+	for attempt := 1; ; attempt++ {
+		bucket, err := a.cluster.OpenBucket(name, "")
+		if err == nil || attempt == tenantBucketAttempts {
+			return bucket, err
+		}
+		time.Sleep(delay)
+		if delay *= 2; delay > maxConnectDelay {
+			delay = maxConnectDelay
+		}
+	}
+}
+
+// removeTenant drops a tenant's bucket, with all of its data, and then
+// deregisters the tenant: if dropping the bucket fails, the tenant is kept,
+// so that removing it may be retried. Its store is closed first, once the
+// requests using it are done, and is kept closed until the tenant is gone,
+// so that it is not opened again meanwhile.
+func (a *App) removeTenant(id string) error {
+	var t recipes.Tenant
+	if err := t.GetTenant(id, a.DB); err != nil {
+		if gocb.IsKeyNotFoundError(err) {
+			return errUnknownTenant
+		}
+		return err
+	}
+
+	a.tenants.Lock()
+	s, ok := a.tenants.stores[id]
+	if !ok {
+		if a.tenants.stores == nil {
+			a.tenants.stores = make(map[string]*tenantStore)
+		}
+		s = &tenantStore{id: id}
+		a.tenants.stores[id] = s
+	}
+	a.tenants.hosts = nil
+	a.tenants.Unlock()
+	s.close()
+
+	cm := a.cluster.Manager(a.user, a.password)
+	buckets, err := cm.GetBuckets()
+	if err != nil {
+		return err
+	}
+	for _, b := range buckets {
+		// Already dropped by an earlier attempt otherwise
+		if b.Name == t.Bucket {
+			if err := cm.RemoveBucket(t.Bucket); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := a.DB.Remove(recipes.TenantType.Key(id), 0); err != nil && !gocb.IsKeyNotFoundError(err) {
+		return err
+	}
+
+	a.tenants.Lock()
+	if a.tenants.stores[id] == s {
+		delete(a.tenants.stores, id)
+	}
+	a.tenants.Unlock()
+	return nil
+}
+
+// tenantClaims are the claims of a tenant token which are checked.
+type tenantClaims struct {
+	Tenant string `json:"tenant"`
+	Expiry int64  `json:"exp"`
+}
+
+// verifyTenantToken checks a JWT signed with HS256, returning its tenant claim.
+func verifyTenantToken(token string, secret []byte) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(secret) == 0 || len(parts) != 3 {
+		return "", errInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeTokenPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return "", errInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errInvalidToken
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return "", errInvalidToken
+	}
+
+	var claims tenantClaims
+	if err := decodeTokenPart(parts[1], &claims); err != nil || claims.Tenant == "" {
+		return "", errInvalidToken
+	}
+	if claims.Expiry != 0 && time.Now().Unix() >= claims.Expiry {
+		return "", errInvalidToken
+	}
+	return claims.Tenant, nil
+}
+
+func decodeTokenPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (a *App) getTenantsEndpoint(w http.ResponseWriter, req *http.Request) {
+	tenants, err := recipes.GetTenants(a.db(req))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respond(w, http.StatusOK, tenants)
+}
+
+func (a *App) createTenantEndpoint(w http.ResponseWriter, req *http.Request) {
+	var t recipes.Tenant
+	if !decodeBody(w, req, &t) {
+		return
+	}
+	if err := a.provisionTenant(&t); err != nil {
+		switch err {
+		case recipes.ErrInvalidTenant:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		case errTenantExists:
+			respondWithError(w, http.StatusConflict, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	respond(w, http.StatusCreated, t)
+}
+
+func (a *App) getTenantEndpoint(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	var t recipes.Tenant
+	if err := t.GetTenant(params["tenant"], a.db(req)); err != nil {
+		if gocb.IsKeyNotFoundError(err) {
+			respondWithError(w, http.StatusNotFound, err.Error())
+		} else {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	respond(w, http.StatusOK, t)
+}
+
+func (a *App) deleteTenantEndpoint(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	if err := a.removeTenant(params["tenant"]); err != nil {
+		if err == errUnknownTenant {
+			respondWithError(w, http.StatusNotFound, err.Error())
+		} else {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	respond(w, http.StatusOK, map[string]string{"result": "success"})
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	// native packages
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	// local packages
+	"restful_couchbase/application"
+	"restful_couchbase/recipes"
+)
+
+// commandConnectTimeout bounds how long subcommands wait for Couchbase
+const commandConnectTimeout = 5 * time.Minute
+
+// runCommand runs a subcommand and returns its exit status
+func runCommand(app *application.App, name string, args []string) int {
+	switch name {
+	case "import":
+		return importCommand(app, args)
+	case "backup":
+		return backupCommand(app, args)
+	case "restore":
+		return restoreCommand(app, args)
+	case "migrate":
+		return migrateCommand(app, args)
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command %q (expected: import, backup, restore or migrate)\n", name)
+	return 2
+}
+
+// tenantUsage describes the -tenant flag shared by the subcommands
+const tenantUsage = "work on the bucket of this tenant (default: the default bucket)"
+
+// connect waits for the app to connect to Couchbase, which subcommands do
+// once their arguments are checked, and returns the bucket of the tenant,
+// or the default bucket if tenant is empty
+func connect(app *application.App, tenant string) (*recipes.Bucket, bool) {
+	if err := app.WaitReady(commandConnectTimeout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, false
+	}
+	db, err := app.TenantBucket(tenant)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Tenant %q: %s\n", tenant, err)
+		return nil, false
+	}
+	return db, true
+}
+
+// importCommand streams a JSON Lines or CSV file into the store:
+//
+//	restful_couchbase import [-tenant id] [-format csv] [-map Title=name] [-dry-run] [-resume line] file
+func importCommand(app *application.App, args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := flags.String("format", "", "jsonl or csv (default: from the file extension)")
+	columns := flags.String("map", "", "CSV column mapping, as column=field,...")
+	dryRun := flags.Bool("dry-run", false, "validate every row without storing anything")
+	fromLine := flags.Int("resume", 0, "skip lines before this one")
+	tenant := flags.String("tenant", "", tenantUsage)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: restful_couchbase import [options] file")
+		flags.PrintDefaults()
+		return 2
+	}
+
+	path := flags.Arg(0)
+	if *format == "" {
+		*format = strings.TrimPrefix(filepath.Ext(path), ".")
+	}
+	columnMap, err := recipes.ParseColumnMap(*columns)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	db, ok := connect(app, *tenant)
+	if !ok {
+		return 1
+	}
+
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+
+	report, err := recipes.ImportRecipes(db, in, recipes.ImportOptions{
+		Format:    *format,
+		Columns:   columnMap,
+		DryRun:    *dryRun,
+		FromLine:  *fromLine,
+		Blocklist: app.Blocklist,
+	})
+	if report != nil {
+		printReport(os.Stdout, report)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Import failed:", err)
+		return 1
+	}
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// backupCommand snapshots every document and the ID counters to a gzipped
+// JSON Lines archive:
+//
+//	restful_couchbase backup [-tenant id] file.jsonl.gz
+func backupCommand(app *application.App, args []string) int {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	tenant := flags.String("tenant", "", tenantUsage)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: restful_couchbase backup [options] file")
+		flags.PrintDefaults()
+		return 2
+	}
+	db, ok := connect(app, *tenant)
+	if !ok {
+		return 1
+	}
+
+	path := flags.Arg(0)
+	var out io.Writer = os.Stdout
+	var f *os.File
+	if path != "-" {
+		var err error
+		if f, err = os.Create(path); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		out = f
+	}
+
+	report, err := recipes.Backup(db, out)
+	if f != nil {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Backup failed:", err)
+		return 1
+	}
+	// The archive itself may be going to stdout
+	printReport(os.Stderr, report)
+	return 0
+}
+
+// restoreCommand loads an archive written by backup, keeping document keys
+// and counter positions. The bucket must be empty unless -force is given:
+//
+//	restful_couchbase restore [-tenant id] [-force] file.jsonl.gz
+func restoreCommand(app *application.App, args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	force := flags.Bool("force", false, "restore into a bucket which is not empty, skipping existing documents")
+	tenant := flags.String("tenant", "", tenantUsage)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: restful_couchbase restore [options] file")
+		flags.PrintDefaults()
+		return 2
+	}
+	db, ok := connect(app, *tenant)
+	if !ok {
+		return 1
+	}
+
+	path := flags.Arg(0)
+	var in *os.File
+	if path == "-" {
+		// The archive is read twice, so standard input is saved first
+		f, err := spool(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		in = f
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+
+	report, err := recipes.Restore(db, in, *force)
+	if report != nil {
+		printReport(os.Stdout, report)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Restore failed:", err)
+		return 1
+	}
+	return 0
+}
+
+// migrateCommand upgrades every recipe document to the current schema
+// version, reporting progress after each batch. An interrupted migration
+// is resumed by running it again:
+//
+//	restful_couchbase migrate [-tenant id] [-list]
+func migrateCommand(app *application.App, args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	list := flags.Bool("list", false, "list the registered migrations, without running them")
+	tenant := flags.String("tenant", "", tenantUsage)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "Usage: restful_couchbase migrate [options]")
+		flags.PrintDefaults()
+		return 2
+	}
+
+	// Listing the migrations does not need Couchbase
+	if *list {
+		for _, m := range recipes.Migrations() {
+			fmt.Printf("%d\t%s\n", m.Version, m.Description)
+		}
+		return 0
+	}
+	db, ok := connect(app, *tenant)
+	if !ok {
+		return 1
+	}
+
+	report, err := recipes.MigrateRecipes(db, func(progress recipes.MigrateReport) {
+		fmt.Fprintf(os.Stderr, "Migrated %d of %d documents scanned, up to ID %s\n",
+			progress.Migrated, progress.Scanned, progress.LastID)
+	})
+	if report != nil {
+		printReport(os.Stdout, report)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Migration failed:", err)
+		return 1
+	}
+	if report.Failed > 0 || report.Conflicts > 0 {
+		return 1
+	}
+	return 0
+}
+
+// spool copies r to a temporary file, which the caller must remove
+func spool(r io.Reader) (*os.File, error) {
+	f, err := os.CreateTemp("", "restful_couchbase-")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(f, r); err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// printReport writes a report as indented JSON
+func printReport(w io.Writer, report interface{}) {
+	out, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Fprintln(w, string(out))
+}
@@ -1,18 +1,70 @@
 package main
 
 import (
-	// native package
+	// native packages
+	"context"
+	"log"
 	"os"
+	"strconv"
+	"strings"
 
-	// local package
-	"application"
+	// local packages
+	"restful_couchbase/application"
+	"restful_couchbase/recipes"
 )
 
 func main() {
+	if err := application.ConfigureLogging(os.Getenv("LOG_LEVEL"), os.Getenv("DB_LOG_LEVEL")); err != nil {
+		log.Fatal("Invalid log level: ", err)
+	}
+
+	shutdownTracing, err := application.InitTracing(os.Getenv("OTEL_TRACES_EXPORTER"))
+	if err != nil {
+		log.Fatal("Failed to set up tracing: ", err)
+	}
+
 	app := application.App{}
+	app.Blocklist = recipes.NewBlocklist(strings.Split(os.Getenv("MODERATION_BLOCKLIST"), ","))
+	app.AdminToken = os.Getenv("ADMIN_TOKEN")
+	app.RatingPrior = recipes.RatingPrior{
+		Mean:   envFloatPtr("RATING_PRIOR_MEAN"),
+		Weight: envFloat("RATING_PRIOR_WEIGHT"),
+	}
+	app.SearchIndex = os.Getenv("COUCHBASE_FTS_INDEX")
+	app.TemplateDir = os.Getenv("TEMPLATE_DIR")
+	app.ConnectAttempts, _ = strconv.Atoi(os.Getenv("COUCHBASE_CONNECT_ATTEMPTS"))
+	app.SkipIndexes, _ = strconv.ParseBool(os.Getenv("COUCHBASE_SKIP_INDEXES"))
+	// Only the service migrates on start, not the subcommands
+	skipMigrations, _ := strconv.ParseBool(os.Getenv("COUCHBASE_SKIP_MIGRATIONS"))
+	app.MigrateOnStart = len(os.Args) == 1 && !skipMigrations
+	app.MultiTenant, _ = strconv.ParseBool(os.Getenv("MULTI_TENANT"))
+	app.TenantSecret = []byte(os.Getenv("TENANT_TOKEN_SECRET"))
+	app.TenantBucketQuota, _ = strconv.Atoi(os.Getenv("TENANT_BUCKET_QUOTA"))
 	app.Initialize(
 		os.Getenv("COUCHBASE_USER"),
 		os.Getenv("COUCHBASE_PASS"),
 		os.Getenv("COUCHBASE_DB"))
+
+	// Anything on the command line is a subcommand, otherwise serve
+	if len(os.Args) > 1 {
+		status := runCommand(&app, os.Args[1], os.Args[2:])
+		shutdownTracing(context.Background())
+		os.Exit(status)
+	}
 	app.Run(os.Getenv("PORT"))
 }
+
+// envFloat returns the value of a numeric environment variable, or 0 if unset
+func envFloat(key string) float32 {
+	f, _ := strconv.ParseFloat(os.Getenv(key), 32)
+	return float32(f)
+}
+
+// envFloatPtr returns the value of a numeric environment variable, or nil if unset
+func envFloatPtr(key string) *float32 {
+	if _, ok := os.LookupEnv(key); !ok {
+		return nil
+	}
+	f := envFloat(key)
+	return &f
+}
@@ -0,0 +1,293 @@
+package recipes
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	// External imports
+	"gopkg.in/couchbase/gocb.v1"
+)
+
+// backupVersion is the version of the backup archive format.
+const backupVersion = 1
+
+// restoreBatchSize is the number of documents written with each batch.
+const restoreBatchSize = 100
+
+// Backup and restore errors.
+var (
+	ErrBucketNotEmpty = errors.New("the bucket is not empty")
+	ErrInvalidBackup  = errors.New("not a backup archive, or the archive is incomplete")
+)
+
+// A backup archive is gzipped JSON Lines: a header, one line per document
+// with its key, and a trailer holding the counters and the document count.
+// Nothing in it is specific to Couchbase, so it may be loaded elsewhere.
+type backupHeader struct {
+	Version int       `json:"version"`
+	Bucket  string    `json:"bucket"`
+	Created time.Time `json:"created"`
+}
+
+type backupDocument struct {
+	ID  string          `json:"id"`
+	Doc json.RawMessage `json:"doc"`
+}
+
+type backupTrailer struct {
+	Documents int               `json:"documents"`
+	Counters  map[string]uint64 `json:"counters"`
+}
+
+// The BackupReport entity is used to report the outcome of a backup or restore.
+// Skipped counts documents which already existed when restoring.
+type BackupReport struct {
+	Documents int               `json:"documents"`
+	Skipped   int               `json:"skipped,omitempty"`
+	Counters  map[string]uint64 `json:"counters"`
+}
+
+// Backup writes every document in the bucket, and the ID counters, to w as
+// a compressed archive. The counters are read after the documents, so any
+// document in the archive has an ID below the saved counter position.
+func Backup(db *Bucket, w io.Writer) (*BackupReport, error) {
+
+	zw := gzip.NewWriter(w)
+	encoder := json.NewEncoder(zw)
+
+	err := encoder.Encode(backupHeader{Version: backupVersion, Bucket: db.Name(), Created: time.Now().UTC()})
+	if err != nil {
+		return nil, err
+	}
+
+	allDocumentsN1ql := "SELECT META(d).id, d AS doc FROM " + db.Keyspace() + " AS d WHERE META(d).id NOT IN $1" +
+		" AND META(d).id > $2 ORDER BY META(d).id LIMIT $3"
+	allDocumentsQuery := gocb.NewN1qlQuery(allDocumentsN1ql).AdHoc(false).Consistency(gocb.RequestPlus)
+
+	report := &BackupReport{Counters: make(map[string]uint64)}
+
+	// Read a batch at a time, as gocb buffers the whole result of a query
+	lastID := ""
+	for {
+		var params []interface{}
+		params = append(params, Counters())
+		params = append(params, lastID)
+		params = append(params, scanBatchSize)
+
+		rows, err := db.ExecuteN1qlQuery(allDocumentsQuery, params)
+		if err != nil {
+			return nil, err
+		}
+
+		var row backupDocument
+		n := 0
+
+		for rows.Next(&row) {
+			if err := encoder.Encode(row); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			report.Documents++
+			lastID = row.ID
+			n++
+			row = backupDocument{}
+		}
+		if err := rows.Close(); err != nil {
+			return nil, err
+		}
+		if n < scanBatchSize {
+			break
+		}
+	}
+
+	// The counters are saved separately from the documents, after them
+	for _, key := range Counters() {
+		var value uint64
+		if _, err := db.Get(key, &value); err != nil {
+			// Never used, so there is nothing to save
+			if gocb.IsKeyNotFoundError(err) {
+				continue
+			}
+			return nil, err
+		}
+		report.Counters[key] = value
+	}
+
+	if err := encoder.Encode(backupTrailer{Documents: report.Documents, Counters: report.Counters}); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Restore loads an archive written by Backup, preserving document keys and
+// counter positions, so that new IDs never collide with restored ones.
+// The bucket must be empty unless force is set; existing documents are then
+// skipped rather than overwritten, and counters are only ever moved forward.
+// The whole archive is checked before anything is written, so that a
+// truncated or corrupt archive is never partly restored.
+func Restore(db *Bucket, r io.ReadSeeker, force bool) (*BackupReport, error) {
+
+	if !force {
+		empty, err := bucketEmpty(db)
+		if err != nil {
+			return nil, err
+		}
+		if !empty {
+			return nil, ErrBucketNotEmpty
+		}
+	}
+
+	if _, err := readBackup(r, func(backupDocument) error { return nil }); err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	report := &BackupReport{Counters: make(map[string]uint64)}
+
+	var batch []gocb.BulkOp
+	trailer, err := readBackup(r, func(doc backupDocument) error {
+		batch = append(batch, &gocb.InsertOp{Key: doc.ID, Value: doc.Doc})
+		if len(batch) < restoreBatchSize {
+			return nil
+		}
+		err := restoreBatch(db, batch, report, force)
+		batch = nil
+		return err
+	})
+	if err != nil {
+		return report, err
+	}
+	if len(batch) > 0 {
+		if err := restoreBatch(db, batch, report, force); err != nil {
+			return report, err
+		}
+	}
+
+	for key, value := range trailer.Counters {
+		if err := restoreCounter(db, key, value); err != nil {
+			return report, err
+		}
+		report.Counters[key] = value
+	}
+	return report, nil
+}
+
+// readBackup reads an archive, passing each document to fn, and returns its
+// trailer. The archive is invalid if the trailer is missing, is followed by
+// anything, or does not match the number of documents read.
+func readBackup(r io.Reader, fn func(backupDocument) error) (*backupTrailer, error) {
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, ErrInvalidBackup
+	}
+	defer zr.Close()
+
+	scanner := bufio.NewScanner(zr)
+	scanner.Buffer(make([]byte, 64*1024), 20*1024*1024)
+
+	var header backupHeader
+	if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &header) != nil || header.Version == 0 {
+		return nil, ErrInvalidBackup
+	}
+	if header.Version > backupVersion {
+		return nil, fmt.Errorf("unsupported backup version %d", header.Version)
+	}
+
+	documents := 0
+	var trailer *backupTrailer
+	for scanner.Scan() {
+		if trailer != nil {
+			return nil, ErrInvalidBackup
+		}
+		var line struct {
+			backupDocument
+			*backupTrailer
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return nil, ErrInvalidBackup
+		}
+		if line.backupTrailer != nil {
+			trailer = line.backupTrailer
+			continue
+		}
+		if line.ID == "" {
+			return nil, ErrInvalidBackup
+		}
+		documents++
+		if err := fn(line.backupDocument); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		// A truncated gzip stream ends with an unexpected EOF
+		return nil, ErrInvalidBackup
+	}
+	if trailer == nil || trailer.Documents != documents {
+		return nil, ErrInvalidBackup
+	}
+	return trailer, nil
+}
+
+func restoreBatch(db *Bucket, batch []gocb.BulkOp, report *BackupReport, force bool) error {
+	if err := db.Do(batch); err != nil {
+		return err
+	}
+	for _, op := range batch {
+		insertOp := op.(*gocb.InsertOp)
+		if force && gocb.IsKeyExistsError(insertOp.Err) {
+			report.Skipped++
+			continue
+		}
+		if insertOp.Err != nil {
+			return fmt.Errorf("document %s: %v", insertOp.Key, insertOp.Err)
+		}
+		report.Documents++
+	}
+	return nil
+}
+
+// restoreCounter sets a counter to value, unless it is already beyond it.
+func restoreCounter(db *Bucket, key string, value uint64) error {
+	var current uint64
+	_, err := db.Get(key, &current)
+	if gocb.IsKeyNotFoundError(err) {
+		// Counters are stored as plain numbers, so it may simply be inserted
+		_, err = db.Insert(key, value, 0)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if current < value {
+		_, _, err = db.Counter(key, int64(value-current), 0, 0)
+	}
+	return err
+}
+
+func bucketEmpty(db *Bucket) (bool, error) {
+
+	countN1ql := "SELECT RAW COUNT(*) FROM " + db.Keyspace()
+	countQuery := gocb.NewN1qlQuery(countN1ql).AdHoc(false).Consistency(gocb.RequestPlus)
+
+	rows, err := db.ExecuteN1qlQuery(countQuery, nil)
+	if err != nil {
+		return false, err
+	}
+
+	var count int
+	if err := rows.One(&count); err != nil {
+		return false, err
+	}
+	return count == 0, nil
+}
@@ -0,0 +1,198 @@
+package recipes
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+
+	// External imports
+	"gopkg.in/couchbase/gocb.v1"
+)
+
+// Batch operation kinds.
+const (
+	OpCreate = "create"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+// MaxBatchSize limits the number of operations in a single batch.
+const MaxBatchSize = 500
+
+// Batch errors, reported per operation.
+var (
+	ErrInvalidRecipe    = errors.New("a recipe needs a name, and preptime and difficulty cannot be negative")
+	ErrInvalidBatchOp   = errors.New("unknown operation, or missing id or recipe")
+	ErrInvalidRecipeID  = errors.New("a recipe id is a number")
+	ErrDuplicateBatchID = errors.New("recipe is the target of an earlier operation in this batch")
+)
+
+// recipeIDPattern matches the keys of recipes, so that a batch cannot
+// touch the counters or documents of other types.
+var recipeIDPattern = regexp.MustCompile(`^[0-9]+$`)
+
+// A BatchOp is a single operation within a batch.
+// Creates need a recipe, updates an id and a recipe, deletes an id.
+type BatchOp struct {
+	Op     string  `json:"op"`
+	ID     string  `json:"id,omitempty"`
+	Recipe *Recipe `json:"recipe,omitempty"`
+}
+
+// A BatchResult reports the outcome of a single batch operation.
+type BatchResult struct {
+	ID     string
+	Recipe *Recipe
+	Err    error
+}
+
+// Validate checks that a recipe is fit to be stored.
+func (r *Recipe) Validate() error {
+	if r.Name == "" || r.PrepTime < 0 || r.Difficulty < 0 {
+		return ErrInvalidRecipe
+	}
+	return nil
+}
+
+func (op BatchOp) validate() error {
+	switch op.Op {
+	case OpCreate:
+		if op.Recipe == nil {
+			return ErrInvalidBatchOp
+		}
+	case OpUpdate:
+		if op.ID == "" || op.Recipe == nil {
+			return ErrInvalidBatchOp
+		}
+		if !recipeIDPattern.MatchString(op.ID) {
+			return ErrInvalidRecipeID
+		}
+	case OpDelete:
+		if op.ID == "" {
+			return ErrInvalidBatchOp
+		}
+		if !recipeIDPattern.MatchString(op.ID) {
+			return ErrInvalidRecipeID
+		}
+		return nil
+	default:
+		return ErrInvalidBatchOp
+	}
+	return op.Recipe.Validate()
+}
+
+// ExecuteBatch applies a batch of operations using bulk operations.
+// IDs for all of the creates are reserved with a single Counter call.
+// Operations are applied concurrently, so each recipe may only be
+// the target of one operation. Results are in the order of ops.
+func ExecuteBatch(db *Bucket, ops []BatchOp) []BatchResult {
+
+	results := make([]BatchResult, len(ops))
+	targeted := make(map[string]bool)
+	creates := 0
+	for i, op := range ops {
+		results[i].ID = op.ID
+		results[i].Recipe = op.Recipe
+		if err := op.validate(); err != nil {
+			results[i].Err = err
+			continue
+		}
+		if op.Op == OpCreate {
+			creates++
+			continue
+		}
+		if targeted[op.ID] {
+			results[i].Err = ErrDuplicateBatchID
+			continue
+		}
+		targeted[op.ID] = true
+	}
+
+	// Reserve a range of IDs: the counter returns the last ID of the range
+	var nextID uint64
+	if creates > 0 {
+		lastID, _, err := db.Counter(RecipeType.Counter, int64(creates), int64(creates), 0)
+		if err != nil {
+			for i, op := range ops {
+				if op.Op == OpCreate && results[i].Err == nil {
+					results[i].Err = err
+				}
+			}
+		}
+		nextID = lastID - uint64(creates) + 1
+	}
+
+	// Updates do not change ratings, so fetch the current documents first
+	gets := make(map[int]*gocb.GetOp)
+	var getOps []gocb.BulkOp
+	for i, op := range ops {
+		if op.Op == OpUpdate && results[i].Err == nil {
+			gets[i] = &gocb.GetOp{Key: op.ID, Value: &Recipe{}}
+			getOps = append(getOps, gets[i])
+		}
+	}
+	if len(getOps) > 0 {
+		err := db.Do(getOps)
+		for i, getOp := range gets {
+			if getOp.Err != nil {
+				results[i].Err = getOp.Err
+			} else if err != nil {
+				results[i].Err = err
+			}
+		}
+	}
+
+	mutations := make(map[int]gocb.BulkOp)
+	var mutationOps []gocb.BulkOp
+	for i, op := range ops {
+		if results[i].Err != nil {
+			continue
+		}
+		switch op.Op {
+		case OpCreate:
+			results[i].ID = strconv.FormatUint(nextID, 10)
+			nextID++
+			mutations[i] = &gocb.InsertOp{Key: results[i].ID, Value: op.Recipe.stored()}
+		case OpUpdate:
+			recipe := gets[i].Value.(*Recipe)
+			recipe.Name = op.Recipe.Name
+			recipe.PrepTime = op.Recipe.PrepTime
+			recipe.Difficulty = op.Recipe.Difficulty
+			recipe.Vegetarian = op.Recipe.Vegetarian
+			recipe.Tags = op.Recipe.Tags
+			if op.Recipe.Status == StatusPending {
+				recipe.Status = StatusPending
+			}
+			results[i].Recipe = recipe
+			// Optimistic locking: fails if changed since it was fetched
+			mutations[i] = &gocb.ReplaceOp{Key: op.ID, Value: recipe.stored(), Cas: gets[i].Cas}
+		case OpDelete:
+			mutations[i] = &gocb.RemoveOp{Key: op.ID}
+		}
+		mutationOps = append(mutationOps, mutations[i])
+	}
+	if len(mutationOps) > 0 {
+		err := db.Do(mutationOps)
+		for i, mutation := range mutations {
+			if opErr := bulkOpError(mutation); opErr != nil {
+				results[i].Err = opErr
+			} else if err != nil {
+				results[i].Err = err
+			}
+		}
+	}
+
+	return results
+}
+
+func bulkOpError(op gocb.BulkOp) error {
+	switch op := op.(type) {
+	case *gocb.InsertOp:
+		return op.Err
+	case *gocb.ReplaceOp:
+		return op.Err
+	case *gocb.RemoveOp:
+		return op.Err
+	}
+	return nil
+}
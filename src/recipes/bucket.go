@@ -0,0 +1,265 @@
+package recipes
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	// External imports
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/couchbase/gocb.v1"
+)
+
+var tracer = otel.Tracer("recipes")
+
+// Log receives database-layer diagnostics: every operation is logged at
+// debug level, and failures other than missing documents at warn level.
+var Log = logrus.New()
+
+var (
+	operationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "couchbase_operation_duration_seconds",
+		Help:    "Duration of Couchbase operations, by operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	operationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "couchbase_operation_errors_total",
+		Help: "Failed Couchbase operations, by operation and kind of error.",
+	}, []string{"operation", "kind"})
+
+	lockContention = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "couchbase_lock_contention_total",
+		Help: "Operations which found a document locked, or changed since it was read.",
+	}, []string{"operation"})
+)
+
+func init() {
+	prometheus.MustRegister(operationDuration, operationErrors, lockContention)
+}
+
+// Bucket is a gocb.Bucket whose operations are measured, traced and logged.
+// Spans are children of the span in the bucket's context, if any.
+type Bucket struct {
+	*gocb.Bucket
+	ctx context.Context
+	log *logrus.Entry
+}
+
+// NewBucket wraps an open bucket.
+func NewBucket(b *gocb.Bucket) *Bucket {
+	return &Bucket{Bucket: b, ctx: context.Background(), log: logrus.NewEntry(Log)}
+}
+
+// WithContext returns a copy of the bucket whose operations are traced within ctx.
+func (b *Bucket) WithContext(ctx context.Context) *Bucket {
+	return &Bucket{Bucket: b.Bucket, ctx: ctx, log: b.log}
+}
+
+// WithLogFields returns a copy of the bucket which adds fields to its log entries.
+func (b *Bucket) WithLogFields(fields logrus.Fields) *Bucket {
+	return &Bucket{Bucket: b.Bucket, ctx: b.ctx, log: b.log.WithFields(fields)}
+}
+
+// Keyspace returns the bucket's name quoted for use in N1QL statements.
+func (b *Bucket) Keyspace() string {
+	return "`" + b.Name() + "`"
+}
+
+// Get measures gocb.Bucket.Get.
+func (b *Bucket) Get(key string, valuePtr interface{}) (cas gocb.Cas, err error) {
+	defer b.track("get", attribute.String("db.couchbase.key", key))(&err)
+	return b.Bucket.Get(key, valuePtr)
+}
+
+// GetAndLock measures gocb.Bucket.GetAndLock. A document which is
+// already locked counts as lock contention.
+func (b *Bucket) GetAndLock(key string, lock uint32, valuePtr interface{}) (cas gocb.Cas, err error) {
+	defer b.track("get_and_lock", attribute.String("db.couchbase.key", key))(&err)
+	return b.Bucket.GetAndLock(key, lock, valuePtr)
+}
+
+// Replace measures gocb.Bucket.Replace. A CAS mismatch counts as lock contention.
+func (b *Bucket) Replace(key string, value interface{}, cas gocb.Cas, expiry uint32) (newCas gocb.Cas, err error) {
+	defer b.track("replace", attribute.String("db.couchbase.key", key))(&err)
+	return b.Bucket.Replace(key, value, cas, expiry)
+}
+
+// Insert measures gocb.Bucket.Insert.
+func (b *Bucket) Insert(key string, value interface{}, expiry uint32) (cas gocb.Cas, err error) {
+	defer b.track("insert", attribute.String("db.couchbase.key", key))(&err)
+	return b.Bucket.Insert(key, value, expiry)
+}
+
+// Remove measures gocb.Bucket.Remove.
+func (b *Bucket) Remove(key string, cas gocb.Cas) (newCas gocb.Cas, err error) {
+	defer b.track("remove", attribute.String("db.couchbase.key", key))(&err)
+	return b.Bucket.Remove(key, cas)
+}
+
+// Counter measures gocb.Bucket.Counter.
+func (b *Bucket) Counter(key string, delta, initial int64, expiry uint32) (value uint64, cas gocb.Cas, err error) {
+	defer b.track("counter", attribute.String("db.couchbase.key", key))(&err)
+	return b.Bucket.Counter(key, delta, initial, expiry)
+}
+
+// Do measures gocb.Bucket.Do, counting the errors of each operation in the batch.
+func (b *Bucket) Do(ops []gocb.BulkOp) (err error) {
+	defer b.track("bulk", attribute.Int("db.couchbase.operations", len(ops)))(&err)
+	err = b.Bucket.Do(ops)
+	for _, op := range ops {
+		var name string
+		var opErr error
+		switch op := op.(type) {
+		case *gocb.GetOp:
+			name, opErr = "bulk_get", op.Err
+		case *gocb.InsertOp:
+			name, opErr = "bulk_insert", op.Err
+		case *gocb.ReplaceOp:
+			name, opErr = "bulk_replace", op.Err
+		case *gocb.RemoveOp:
+			name, opErr = "bulk_remove", op.Err
+		}
+		if opErr != nil {
+			countError(name, opErr)
+		}
+	}
+	return err
+}
+
+// ExecuteN1qlQuery measures gocb.Bucket.ExecuteN1qlQuery. The query is
+// measured until its results are closed, so that it includes the
+// processing of the rows.
+func (b *Bucket) ExecuteN1qlQuery(q *gocb.N1qlQuery, params interface{}) (gocb.QueryResults, error) {
+	finish := b.start("n1ql", attribute.String("db.statement", statement(q)))
+	results, err := b.Bucket.ExecuteN1qlQuery(q, params)
+	if err != nil {
+		finish(err)
+		return nil, err
+	}
+	return &trackedResults{QueryResults: results, finish: finish}, nil
+}
+
+// ExecuteSearchQuery measures gocb.Bucket.ExecuteSearchQuery.
+func (b *Bucket) ExecuteSearchQuery(q *gocb.SearchQuery) (results gocb.SearchResults, err error) {
+	defer b.track("search")(&err)
+	return b.Bucket.ExecuteSearchQuery(q)
+}
+
+// track starts an operation; the returned function finishes it, given
+// the operation's error.
+func (b *Bucket) track(operation string, attrs ...attribute.KeyValue) func(*error) {
+	finish := b.start(operation, attrs...)
+	return func(err *error) {
+		finish(*err)
+	}
+}
+
+// start begins measuring, tracing and logging an operation.
+func (b *Bucket) start(operation string, attrs ...attribute.KeyValue) func(error) {
+	start := time.Now()
+	_, span := tracer.Start(b.ctx, "couchbase."+operation, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(append(attrs, attribute.String("db.system", "couchbase"))...))
+	return func(err error) {
+		elapsed := time.Since(start)
+		operationDuration.WithLabelValues(operation).Observe(elapsed.Seconds())
+		if err != nil {
+			countError(operation, err)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+		b.logOperation(operation, elapsed, err, attrs)
+	}
+}
+
+func (b *Bucket) logOperation(operation string, elapsed time.Duration, err error, attrs []attribute.KeyValue) {
+	level := logrus.DebugLevel
+	if err != nil && !gocb.IsKeyNotFoundError(err) {
+		level = logrus.WarnLevel
+	}
+	if !b.log.Logger.IsLevelEnabled(level) {
+		return
+	}
+	fields := logrus.Fields{
+		"operation":   operation,
+		"duration_ms": float64(elapsed.Microseconds()) / 1000,
+	}
+	for _, attr := range attrs {
+		fields[string(attr.Key)] = attr.Value.Emit()
+	}
+	entry := b.log.WithFields(fields)
+	if err != nil {
+		entry = entry.WithError(err)
+	}
+	entry.Log(level, "couchbase "+operation)
+}
+
+// trackedResults finishes a N1QL query when its results are closed.
+type trackedResults struct {
+	gocb.QueryResults
+	finish func(error)
+	done   bool
+}
+
+func (r *trackedResults) Close() error {
+	err := r.QueryResults.Close()
+	r.finished(err)
+	return err
+}
+
+// One closes the results itself.
+func (r *trackedResults) One(valuePtr interface{}) error {
+	err := r.QueryResults.One(valuePtr)
+	r.finished(err)
+	return err
+}
+
+func (r *trackedResults) finished(err error) {
+	if !r.done {
+		r.done = true
+		r.finish(err)
+	}
+}
+
+// statement returns the text of a N1QL query. gocb v1 keeps it in an
+// unexported map, with no accessor, so it is read by reflection.
+func statement(q *gocb.N1qlQuery) string {
+	options := reflect.ValueOf(q).Elem().FieldByName("options")
+	if options.Kind() != reflect.Map {
+		return ""
+	}
+	s := options.MapIndex(reflect.ValueOf("statement"))
+	if s.Kind() == reflect.Interface {
+		s = s.Elem()
+	}
+	if s.Kind() != reflect.String {
+		return ""
+	}
+	return s.String()
+}
+
+func countError(operation string, err error) {
+	kind := "other"
+	switch {
+	case gocb.IsKeyNotFoundError(err):
+		kind = "not_found"
+	case gocb.IsKeyExistsError(err):
+		kind = "exists"
+	case err == gocb.ErrTmpFail:
+		kind = "locked"
+	case err == gocb.ErrTimeout:
+		kind = "timeout"
+	}
+	operationErrors.WithLabelValues(operation, kind).Inc()
+
+	// Pessimistic locks fail with a temporary failure, optimistic ones with a CAS mismatch
+	if kind == "locked" || kind == "exists" && (operation == "replace" || operation == "bulk_replace") {
+		lockContention.WithLabelValues(operation).Inc()
+	}
+}
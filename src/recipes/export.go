@@ -0,0 +1,131 @@
+package recipes
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// FormatJSON exports a single JSON array.
+const FormatJSON = "json"
+
+// exportFlushRows is the number of rows written between flushes.
+const exportFlushRows = 100
+
+// The ExportedRecipe entity is used to export a recipe along with its ID.
+type ExportedRecipe struct {
+	ID string `json:"id"`
+	Recipe
+}
+
+type exportedRecipe struct {
+	ID string `json:"id"`
+	recipeDocument
+}
+
+// MarshalJSON writes the ID alongside the fields of the recipe.
+func (r ExportedRecipe) MarshalJSON() ([]byte, error) {
+	return json.Marshal(exportedRecipe{r.ID, recipeDocument(r.Recipe)})
+}
+
+// UnmarshalJSON reads the ID, which the recipe's own UnmarshalJSON,
+// being promoted, would otherwise skip.
+func (r *ExportedRecipe) UnmarshalJSON(b []byte) error {
+	var doc struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return err
+	}
+	r.ID = doc.ID
+	return r.Recipe.UnmarshalJSON(b)
+}
+
+// ExportRecipes streams every recipe, whatever its moderation status and
+// including ratings, to w in JSON Lines, CSV or JSON format. Recipes are
+// read a batch at a time, in key order, so the collection is never held
+// in memory. If flush is not nil it is called every so often.
+func ExportRecipes(db *Bucket, w io.Writer, format string, flush func()) error {
+
+	var write func(ExportedRecipe) error
+	var finish func() error
+
+	switch format {
+	case FormatJSONL:
+		encoder := json.NewEncoder(w)
+		write = func(r ExportedRecipe) error { return encoder.Encode(r) }
+		finish = func() error { return nil }
+	case FormatJSON:
+		if _, err := io.WriteString(w, "["); err != nil {
+			return err
+		}
+		separator := "\n"
+		write = func(r ExportedRecipe) error {
+			b, err := json.Marshal(r)
+			if err != nil {
+				return err
+			}
+			if _, err = io.WriteString(w, separator); err != nil {
+				return err
+			}
+			separator = ",\n"
+			_, err = w.Write(b)
+			return err
+		}
+		finish = func() error {
+			_, err := io.WriteString(w, "\n]\n")
+			return err
+		}
+	case FormatCSV:
+		csvWriter := csv.NewWriter(w)
+		if err := csvWriter.Write(append([]string{"id"}, append(csvFields, "status")...)); err != nil {
+			return err
+		}
+		write = func(r ExportedRecipe) error {
+			ratings := make([]string, len(r.Ratings))
+			for i, rating := range r.Ratings {
+				ratings[i] = strconv.Itoa(rating)
+			}
+			err := csvWriter.Write([]string{
+				r.ID,
+				r.Name,
+				strconv.FormatFloat(float64(r.PrepTime), 'f', -1, 32),
+				strconv.Itoa(r.Difficulty),
+				strconv.FormatBool(r.Vegetarian),
+				strings.Join(r.Tags, ";"),
+				strings.Join(ratings, ";"),
+				r.Status,
+			})
+			if err != nil {
+				return err
+			}
+			// Push each row through to w, so that flushes reach the client
+			csvWriter.Flush()
+			return csvWriter.Error()
+		}
+		finish = func() error {
+			csvWriter.Flush()
+			return csvWriter.Error()
+		}
+	default:
+		return ErrUnknownFormat
+	}
+
+	rows := 0
+	err := forEachRecipe(db, isRecipe, func(row N1qlRecipe) error {
+		if err := write(ExportedRecipe{ID: row.ID, Recipe: row.Recipe}); err != nil {
+			return err
+		}
+		rows++
+		if flush != nil && rows%exportFlushRows == 0 {
+			flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return finish()
+}
@@ -0,0 +1,78 @@
+package recipes
+
+import (
+	"fmt"
+
+	// External imports
+	"gopkg.in/couchbase/gocb.v1"
+)
+
+// prepTimeBucket is the N1QL expression for the preptime facet buckets;
+// it is bound as prep_bucket, BUCKET being a reserved word.
+const prepTimeBucket = `CASE WHEN recipe.preptime < 15 THEN "<15"` +
+	` WHEN recipe.preptime < 30 THEN "15-30"` +
+	` WHEN recipe.preptime < 60 THEN "30-60"` +
+	` ELSE "60+" END`
+
+// The Facets entity is used to report counts of the recipes matching a search.
+type Facets struct {
+	Vegetarian map[string]int `json:"vegetarian"`
+	Difficulty map[string]int `json:"difficulty"`
+	PrepTime   map[string]int `json:"preptime"`
+	Tags       map[string]int `json:"tags"`
+}
+
+type facetRow struct {
+	Key   interface{} `json:"key"`
+	Count int         `json:"count"`
+}
+
+// GetSearchFacets returns facet counts for the recipes matching the filter.
+// For text searches, ids restricts the counts to the matching recipes.
+func GetSearchFacets(db *Bucket, filter SearchFilter, ids []string) (*Facets, error) {
+
+	where := " WHERE recipe.preptime < $1 AND " + visibleRecipe
+	var params []interface{}
+	params = append(params, filter.PrepTime)
+	if ids != nil {
+		where += " AND META(recipe).id IN $2"
+		params = append(params, ids)
+	}
+
+	facetN1ql := []string{
+		"SELECT recipe.vegetarian AS `key`, COUNT(*) AS count FROM " + db.Keyspace() + " AS recipe" + where +
+			" GROUP BY recipe.vegetarian",
+		"SELECT recipe.difficulty AS `key`, COUNT(*) AS count FROM " + db.Keyspace() + " AS recipe" + where +
+			" GROUP BY recipe.difficulty",
+		"SELECT prep_bucket AS `key`, COUNT(*) AS count FROM " + db.Keyspace() + " AS recipe LET prep_bucket = " + prepTimeBucket + where +
+			" GROUP BY prep_bucket",
+		"SELECT tag AS `key`, COUNT(*) AS count FROM " + db.Keyspace() + " AS recipe UNNEST recipe.tags AS tag" + where +
+			" GROUP BY tag",
+	}
+
+	facets := &Facets{
+		Vegetarian: make(map[string]int),
+		Difficulty: make(map[string]int),
+		PrepTime:   make(map[string]int),
+		Tags:       make(map[string]int),
+	}
+	counts := []map[string]int{facets.Vegetarian, facets.Difficulty, facets.PrepTime, facets.Tags}
+
+	for i, n1ql := range facetN1ql {
+		rows, err := db.ExecuteN1qlQuery(gocb.NewN1qlQuery(n1ql).AdHoc(false), params)
+		if err != nil {
+			return nil, err
+		}
+		var row facetRow
+		for rows.Next(&row) {
+			if row.Key != nil {
+				counts[i][fmt.Sprint(row.Key)] = row.Count
+			}
+			row = facetRow{}
+		}
+		if err = rows.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return facets, nil
+}
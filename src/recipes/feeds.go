@@ -0,0 +1,99 @@
+package recipes
+
+import (
+	"time"
+
+	// External imports
+	"gopkg.in/couchbase/gocb.v1"
+)
+
+// GetTopRecipes returns a collection of rated recipes, best first.
+// Recipes are ranked by their Bayesian score.
+func GetTopRecipes(db *Bucket, start int, count int, prior RatingPrior) ([]RecipeRated, error) {
+
+	mean, weight := prior.values()
+
+	topRecipesN1ql := "SELECT META().id, * FROM " + db.Keyspace() + " AS recipe WHERE ARRAY_LENGTH(recipe.ratings) > 0 AND " + visibleRecipe +
+		" ORDER BY " + scoreN1ql("$3", "$4") + " DESC, META(recipe).id LIMIT $1 OFFSET $2"
+	topRecipesQuery := gocb.NewN1qlQuery(topRecipesN1ql).AdHoc(false)
+
+	var params []interface{}
+	params = append(params, count)
+	params = append(params, start)
+	params = append(params, mean)
+	params = append(params, weight)
+
+	return getFeed(db, topRecipesQuery, params, prior, nil)
+}
+
+// GetTrendingRecipes returns a collection of the recipes which
+// have been rated most often within the specified time window.
+func GetTrendingRecipes(db *Bucket, start int, count int, window time.Duration, prior RatingPrior) ([]RecipeRated, error) {
+
+	since := time.Now().Add(-window).Unix()
+
+	trendingRecipesN1ql := "SELECT META().id, * FROM " + db.Keyspace() + " AS recipe" +
+		" WHERE ANY t IN recipe.rated_at SATISFIES t >= $3 END AND " + visibleRecipe +
+		" ORDER BY ARRAY_LENGTH(ARRAY t FOR t IN recipe.rated_at WHEN t >= $3 END) DESC, META(recipe).id" +
+		" LIMIT $1 OFFSET $2"
+	trendingRecipesQuery := gocb.NewN1qlQuery(trendingRecipesN1ql).AdHoc(false)
+
+	var params []interface{}
+	params = append(params, count)
+	params = append(params, start)
+	params = append(params, since)
+
+	// Velocity is expressed as ratings per day
+	days := float32(window.Hours() / 24)
+	velocity := func(rr *RecipeRated, row N1qlRecipe) {
+		recent := 0
+		for _, t := range row.Recipe.RatedAt {
+			if t >= since {
+				recent++
+			}
+		}
+		rr.Velocity = float32(recent) / days
+	}
+
+	return getFeed(db, trendingRecipesQuery, params, prior, velocity)
+}
+
+// GetNewRecipes returns a collection of recipes, newest first.
+func GetNewRecipes(db *Bucket, start int, count int, prior RatingPrior) ([]RecipeRated, error) {
+
+	// Recipe IDs are allocated in sequence, so the highest IDs are the newest
+	newRecipesN1ql := "SELECT META().id, * FROM " + db.Keyspace() + " AS recipe WHERE " + visibleRecipe +
+		" ORDER BY TONUMBER(META(recipe).id) DESC LIMIT $1 OFFSET $2"
+	newRecipesQuery := gocb.NewN1qlQuery(newRecipesN1ql).AdHoc(false)
+
+	var params []interface{}
+	params = append(params, count)
+	params = append(params, start)
+
+	return getFeed(db, newRecipesQuery, params, prior, nil)
+}
+
+// getFeed executes a feed query, optionally decorating each result.
+func getFeed(db *Bucket, query *gocb.N1qlQuery, params []interface{}, prior RatingPrior,
+	decorate func(*RecipeRated, N1qlRecipe)) ([]RecipeRated, error) {
+
+	rows, err := db.ExecuteN1qlQuery(query, params)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	recipesRated := []RecipeRated{}
+
+	var row N1qlRecipe
+
+	for rows.Next(&row) {
+		recipeRated := rated(row, prior)
+		if decorate != nil {
+			decorate(&recipeRated, row)
+		}
+		recipesRated = append(recipesRated, recipeRated)
+		row = N1qlRecipe{}
+	}
+	return recipesRated, nil
+}
@@ -0,0 +1,118 @@
+package recipes
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	// External imports
+	"gopkg.in/couchbase/gocb.v1"
+)
+
+// healthTimeout bounds each health check
+const healthTimeout = 2 * time.Second
+
+// Health check statuses.
+const (
+	CheckOK   = "ok"
+	CheckFail = "fail"
+)
+
+// A CheckResult reports the outcome of a single health check.
+type CheckResult struct {
+	Status    string  `json:"status"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+// OK reports whether the check passed.
+func (c CheckResult) OK() bool {
+	return c.Status == CheckOK
+}
+
+// CheckReadiness runs every check needed before the bucket can serve
+// requests: the data service answers a ping, the query service answers
+// a query, and the bucket's indexes (including a primary index) are online.
+func CheckReadiness(db *Bucket) map[string]CheckResult {
+	return map[string]CheckResult{
+		"bucket":  runCheck(func() error { return checkBucket(db) }),
+		"query":   runCheck(func() error { return checkQuery(db) }),
+		"indexes": runCheck(func() error { return checkIndexes(db) }),
+	}
+}
+
+func runCheck(check func() error) CheckResult {
+	start := time.Now()
+	err := check()
+	result := CheckResult{Status: CheckOK, LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		result.Status = CheckFail
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func checkBucket(db *Bucket) error {
+	report, err := db.Ping([]gocb.ServiceType{gocb.MemdService})
+	if err != nil {
+		return err
+	}
+	if len(report.Services) == 0 {
+		return fmt.Errorf("no data service endpoints")
+	}
+	for _, service := range report.Services {
+		if !service.Success {
+			return fmt.Errorf("data service at %s did not answer", service.Endpoint)
+		}
+	}
+	return nil
+}
+
+func checkQuery(db *Bucket) error {
+	query := gocb.NewN1qlQuery("SELECT RAW 1").Timeout(healthTimeout)
+	rows, err := db.ExecuteN1qlQuery(query, nil)
+	if err != nil {
+		return err
+	}
+	var one int
+	return rows.One(&one)
+}
+
+func checkIndexes(db *Bucket) error {
+
+	indexesN1ql := "SELECT name, state, IFMISSING(is_primary, false) AS is_primary FROM system:indexes WHERE keyspace_id = $1"
+	indexesQuery := gocb.NewN1qlQuery(indexesN1ql).AdHoc(false).Timeout(healthTimeout)
+
+	var params []interface{}
+	params = append(params, db.Name())
+
+	rows, err := db.ExecuteN1qlQuery(indexesQuery, params)
+	if err != nil {
+		return err
+	}
+
+	var index struct {
+		Name      string `json:"name"`
+		State     string `json:"state"`
+		IsPrimary bool   `json:"is_primary"`
+	}
+	primary := false
+	var notOnline []string
+	for rows.Next(&index) {
+		if index.State != "online" {
+			notOnline = append(notOnline, index.Name+" ("+index.State+")")
+		} else if index.IsPrimary {
+			primary = true
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	if len(notOnline) > 0 {
+		return fmt.Errorf("indexes not online: %s", strings.Join(notOnline, ", "))
+	}
+	if !primary {
+		return fmt.Errorf("no primary index on %s", db.Name())
+	}
+	return nil
+}
@@ -0,0 +1,320 @@
+package recipes
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Import and export formats.
+const (
+	FormatJSONL = "jsonl"
+	FormatCSV   = "csv"
+)
+
+// importBatchSize is the number of rows written with each batch.
+const importBatchSize = 100
+
+// csvFields are the recipe fields which may be mapped from CSV columns.
+// Lists (tags and ratings) are separated by semicolons.
+var csvFields = []string{"name", "preptime", "difficulty", "vegetarian", "tags", "ratings"}
+
+// ErrUnknownFormat is returned for an unsupported import or export format.
+var ErrUnknownFormat = errors.New("unknown format")
+
+// ImportOptions control an import.
+type ImportOptions struct {
+	Format string
+
+	// Columns maps CSV column headers onto recipe fields.
+	// Columns named after a recipe field are mapped by default.
+	Columns map[string]string
+
+	// DryRun validates every row without storing anything.
+	DryRun bool
+
+	// FromLine resumes an import; earlier lines are skipped.
+	FromLine int
+
+	Blocklist *Blocklist
+}
+
+// A RowError reports a row which could not be imported.
+type RowError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// The ImportReport entity is used to report the outcome of an import.
+// Lines are numbered from 1; for CSV each record counts as a line and
+// the header is line 1. If the import stopped early, it may be resumed
+// from ResumeFrom.
+type ImportReport struct {
+	DryRun     bool       `json:"dry_run"`
+	Read       int        `json:"read"`
+	Skipped    int        `json:"skipped"`
+	Imported   int        `json:"imported"`
+	Failed     int        `json:"failed"`
+	Errors     []RowError `json:"errors"`
+	ResumeFrom int        `json:"resume_from,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+type importRow struct {
+	line   int
+	recipe *Recipe
+}
+
+// ParseColumnMap parses a column mapping of the form "Title=name,Minutes=preptime".
+func ParseColumnMap(spec string) (map[string]string, error) {
+	columns := make(map[string]string)
+	if spec == "" {
+		return columns, nil
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || !isCSVField(kv[1]) {
+			return nil, fmt.Errorf("invalid column mapping %q (expected column=field, fields are %s)",
+				pair, strings.Join(csvFields, ", "))
+		}
+		columns[strings.TrimSpace(kv[0])] = kv[1]
+	}
+	return columns, nil
+}
+
+func isCSVField(field string) bool {
+	for _, f := range csvFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// ImportRecipes streams recipes in JSON Lines or CSV format into the bucket.
+// Invalid rows are reported and skipped. The import stops if a whole batch
+// of rows cannot be stored; nothing from that batch has been written, so
+// the import may be resumed from the line given in the report. The import
+// also stops if the input cannot be read any further (a line over 1 MiB,
+// or a truncated upload); the rows read so far are stored first.
+func ImportRecipes(db *Bucket, r io.Reader, opts ImportOptions) (*ImportReport, error) {
+
+	report := &ImportReport{DryRun: opts.DryRun, Errors: []RowError{}}
+
+	var next func() (*importRow, error)
+	switch opts.Format {
+	case FormatJSONL:
+		next = jsonlRows(r)
+	case FormatCSV:
+		var err error
+		if next, err = csvRows(r, opts.Columns); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrUnknownFormat
+	}
+
+	var batch []importRow
+	lastLine := 0
+	for {
+		row, err := next()
+		if err == io.EOF {
+			break
+		}
+		if row == nil {
+			// The input itself cannot be read any further
+			if len(batch) > 0 {
+				if err := importBatch(db, batch, report); err != nil {
+					return report, err
+				}
+			}
+			report.ResumeFrom = lastLine + 1
+			report.Error = err.Error()
+			return report, err
+		}
+		lastLine = row.line
+		if row.line < opts.FromLine {
+			report.Skipped++
+			continue
+		}
+		report.Read++
+		if err == nil {
+			err = row.recipe.Validate()
+		}
+		if err != nil {
+			report.Failed++
+			report.Errors = append(report.Errors, RowError{Line: row.line, Error: err.Error()})
+			continue
+		}
+		row.recipe.Moderate(opts.Blocklist)
+		if opts.DryRun {
+			report.Imported++
+			continue
+		}
+		batch = append(batch, *row)
+		if len(batch) == importBatchSize {
+			if err := importBatch(db, batch, report); err != nil {
+				return report, err
+			}
+			batch = nil
+		}
+	}
+	if len(batch) > 0 {
+		if err := importBatch(db, batch, report); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// importBatch writes a batch of rows, recording any rows which failed.
+func importBatch(db *Bucket, batch []importRow, report *ImportReport) error {
+
+	ops := make([]BatchOp, len(batch))
+	for i, row := range batch {
+		ops[i] = BatchOp{Op: OpCreate, Recipe: row.recipe}
+	}
+
+	results := ExecuteBatch(db, ops)
+
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+		}
+	}
+	if failed == len(batch) {
+		report.ResumeFrom = batch[0].line
+		report.Error = results[0].Err.Error()
+		return results[0].Err
+	}
+
+	for i, result := range results {
+		if result.Err != nil {
+			report.Failed++
+			report.Errors = append(report.Errors, RowError{Line: batch[i].line, Error: result.Err.Error()})
+		} else {
+			report.Imported++
+		}
+	}
+	return nil
+}
+
+// jsonlRows returns a reader of JSON Lines rows. Blank lines are ignored.
+func jsonlRows(r io.Reader) func() (*importRow, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	return func() (*importRow, error) {
+		for scanner.Scan() {
+			line++
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" {
+				continue
+			}
+			row := &importRow{line: line, recipe: &Recipe{}}
+			return row, json.Unmarshal([]byte(text), row.recipe)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+}
+
+// csvRows returns a reader of CSV rows, mapping columns onto recipe fields.
+func csvRows(r io.Reader, columns map[string]string) (func() (*importRow, error), error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	fields := make([]string, len(header))
+	for i, column := range header {
+		column = strings.TrimSpace(column)
+		if field, ok := columns[column]; ok {
+			fields[i] = field
+		} else if isCSVField(column) {
+			fields[i] = column
+		}
+	}
+
+	line := 1
+	return func() (*importRow, error) {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		line++
+		row := &importRow{line: line, recipe: &Recipe{}}
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); ok {
+				return row, err
+			}
+			return nil, err
+		}
+		for i, value := range record {
+			if i >= len(fields) || fields[i] == "" {
+				continue
+			}
+			if err := setCSVField(row.recipe, fields[i], strings.TrimSpace(value)); err != nil {
+				return row, err
+			}
+		}
+		return row, nil
+	}, nil
+}
+
+func setCSVField(r *Recipe, field, value string) error {
+	var err error
+	switch field {
+	case "name":
+		r.Name = value
+	case "preptime":
+		var f float64
+		f, err = strconv.ParseFloat(value, 32)
+		r.PrepTime = float32(f)
+	case "difficulty":
+		r.Difficulty, err = strconv.Atoi(value)
+	case "vegetarian":
+		switch strings.ToLower(value) {
+		case "y", "yes":
+			r.Vegetarian = true
+		case "", "n", "no":
+			r.Vegetarian = false
+		default:
+			r.Vegetarian, err = strconv.ParseBool(value)
+		}
+	case "tags":
+		r.Tags = splitList(value)
+	case "ratings":
+		for _, s := range splitList(value) {
+			var rating int
+			if rating, err = strconv.Atoi(s); err != nil {
+				break
+			}
+			r.Ratings = append(r.Ratings, rating)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s %q", field, value)
+	}
+	return nil
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, s := range strings.Split(value, ";") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
@@ -0,0 +1,53 @@
+package recipes
+
+import (
+	"time"
+
+	// External imports
+	"gopkg.in/couchbase/gocb.v1"
+)
+
+// indexBuildTimeout bounds how long EnsureIndexes waits for indexes to come online
+const indexBuildTimeout = 5 * time.Minute
+
+// An Index is a secondary index required by the queries of this package.
+type Index struct {
+	Name   string
+	Fields []string
+}
+
+// RequiredIndexes are the secondary indexes used by the N1QL queries; a
+// primary index is required too, for the queries without a usable index.
+var RequiredIndexes = []Index{
+	{Name: "idx_preptime", Fields: []string{"`preptime`"}},
+	{Name: "idx_name", Fields: []string{"`name`"}},
+	{Name: "idx_type", Fields: []string{"`type`", "`user`"}},
+	{Name: "idx_status", Fields: []string{"`status`"}},
+}
+
+// EnsureIndexes creates the primary index and any missing required index,
+// then waits for them all to be online. Indexes are created deferred and
+// built together, which is faster than building them one by one.
+func EnsureIndexes(manager *gocb.BucketManager) error {
+	if err := manager.CreatePrimaryIndex("", true, true); err != nil {
+		return err
+	}
+
+	var names []string
+	for _, index := range RequiredIndexes {
+		if err := manager.CreateIndex(index.Name, index.Fields, true, true); err != nil {
+			return err
+		}
+		names = append(names, index.Name)
+	}
+
+	built, err := manager.BuildDeferredIndexes()
+	if err != nil {
+		return err
+	}
+	if len(built) > 0 {
+		Log.WithField("indexes", built).Info("Building indexes")
+	}
+
+	return manager.WatchIndexes(names, true, indexBuildTimeout)
+}
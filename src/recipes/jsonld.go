@@ -0,0 +1,188 @@
+package recipes
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// schema.org vocabulary used by JSON-LD recipes.
+const (
+	schemaContext  = "https://schema.org"
+	vegetarianDiet = "https://schema.org/VegetarianDiet"
+	bestRating     = 5
+	worstRating    = 1
+)
+
+// ErrInvalidJSONLD is returned for a JSON-LD document which is not a usable schema.org Recipe.
+var ErrInvalidJSONLD = errors.New("expected a schema.org Recipe with a name and an ISO 8601 prepTime")
+
+// The JSONLDRecipe entity is used to marshall/unmarshall a schema.org Recipe
+// in JSON-LD. Prep time is an ISO 8601 duration, difficulty is carried as
+// an additional property and tags as keywords.
+type JSONLDRecipe struct {
+	Context            interface{}      `json:"@context,omitempty"`
+	Type               textList         `json:"@type"`
+	Identifier         string           `json:"identifier,omitempty"`
+	Name               string           `json:"name"`
+	PrepTime           string           `json:"prepTime,omitempty"`
+	SuitableForDiet    textList         `json:"suitableForDiet,omitempty"`
+	Keywords           textList         `json:"keywords,omitempty"`
+	AggregateRating    *AggregateRating `json:"aggregateRating,omitempty"`
+	AdditionalProperty []PropertyValue  `json:"additionalProperty,omitempty"`
+}
+
+// An AggregateRating summarizes the ratings of a JSON-LD recipe.
+type AggregateRating struct {
+	Type        string  `json:"@type"`
+	RatingValue float32 `json:"ratingValue"`
+	RatingCount int     `json:"ratingCount"`
+	BestRating  int     `json:"bestRating"`
+	WorstRating int     `json:"worstRating"`
+}
+
+// A PropertyValue is a named value without a schema.org property of its own.
+type PropertyValue struct {
+	Type  string      `json:"@type"`
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+// textList is a list of text which may be written as a single string;
+// a single string is split on commas, as keywords usually are.
+type textList []string
+
+func (l textList) MarshalJSON() ([]byte, error) {
+	if len(l) == 1 {
+		return json.Marshal(l[0])
+	}
+	return json.Marshal([]string(l))
+}
+
+func (l *textList) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*l = nil
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*l = append(*l, item)
+			}
+		}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(l))
+}
+
+func (l textList) contains(s string) bool {
+	for _, item := range l {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// JSONLD returns a recipe as a schema.org Recipe. Ratings are only
+// summarized once there are some.
+func (r RecipeRated) JSONLD() JSONLDRecipe {
+	doc := JSONLDRecipe{
+		Context:    schemaContext,
+		Type:       textList{"Recipe"},
+		Identifier: r.ID,
+		Name:       r.Name,
+		PrepTime:   isoDuration(r.PrepTime),
+		Keywords:   r.Tags,
+		AdditionalProperty: []PropertyValue{
+			{Type: "PropertyValue", Name: "difficulty", Value: r.Difficulty},
+		},
+	}
+	if r.Vegetarian {
+		doc.SuitableForDiet = textList{vegetarianDiet}
+	}
+	if r.RatingCount > 0 {
+		doc.AggregateRating = &AggregateRating{
+			Type:        "AggregateRating",
+			RatingValue: r.AvgRating,
+			RatingCount: r.RatingCount,
+			BestRating:  bestRating,
+			WorstRating: worstRating,
+		}
+	}
+	return doc
+}
+
+// Recipe maps a schema.org Recipe onto a recipe. Ratings are not
+// imported, as only their summary is known.
+func (doc JSONLDRecipe) Recipe() (Recipe, error) {
+	if !doc.Type.contains("Recipe") || doc.Name == "" {
+		return Recipe{}, ErrInvalidJSONLD
+	}
+	r := Recipe{Name: doc.Name, Tags: doc.Keywords}
+	if doc.PrepTime != "" {
+		preptime, ok := parseISODuration(doc.PrepTime)
+		if !ok {
+			return Recipe{}, ErrInvalidJSONLD
+		}
+		r.PrepTime = preptime
+	}
+	for _, diet := range doc.SuitableForDiet {
+		// Diets may be full or short names, and vegan recipes are vegetarian too
+		switch diet[strings.LastIndex(diet, "/")+1:] {
+		case "VegetarianDiet", "VeganDiet":
+			r.Vegetarian = true
+		}
+	}
+	for _, p := range doc.AdditionalProperty {
+		if p.Name != "difficulty" {
+			continue
+		}
+		switch v := p.Value.(type) {
+		case float64:
+			r.Difficulty = int(v)
+		case string:
+			r.Difficulty, _ = strconv.Atoi(v)
+		}
+	}
+	return r, nil
+}
+
+// isoDuration formats a prep time in minutes as an ISO 8601 duration.
+func isoDuration(minutes float32) string {
+	seconds := int(math.Round(float64(minutes) * 60))
+	if seconds <= 0 {
+		return "PT0M"
+	}
+	d := "PT"
+	if h := seconds / 3600; h > 0 {
+		d += strconv.Itoa(h) + "H"
+	}
+	if m := seconds % 3600 / 60; m > 0 {
+		d += strconv.Itoa(m) + "M"
+	}
+	if s := seconds % 60; s > 0 {
+		d += strconv.Itoa(s) + "S"
+	}
+	return d
+}
+
+var isoDurationPattern = regexp.MustCompile(`^P(?:(\d+(?:\.\d+)?)D)?(?:T(?:(\d+(?:\.\d+)?)H)?(?:(\d+(?:\.\d+)?)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseISODuration parses an ISO 8601 duration of days, hours, minutes
+// and seconds, returning it in minutes.
+func parseISODuration(d string) (float32, bool) {
+	parts := isoDurationPattern.FindStringSubmatch(d)
+	if parts == nil || d == "P" || strings.HasSuffix(d, "T") {
+		return 0, false
+	}
+	var minutes float64
+	for i, scale := range []float64{24 * 60, 60, 1, 1.0 / 60} {
+		if parts[i+1] != "" {
+			n, _ := strconv.ParseFloat(parts[i+1], 64)
+			minutes += n * scale
+		}
+	}
+	return float32(minutes), true
+}
@@ -0,0 +1,259 @@
+package recipes
+
+import (
+	"encoding/json"
+	"fmt"
+
+	// External imports
+	"gopkg.in/couchbase/gocb.v1"
+)
+
+// migrateBatchSize is the number of documents migrated with each batch.
+const migrateBatchSize = 100
+
+// A Migration upgrades a recipe document from the previous schema version
+// to Version. It works on the raw document, so that it sees fields which
+// are missing or no longer part of Recipe.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(doc map[string]interface{}) error
+}
+
+// migrations are the registered migrations, in version order; appending
+// one raises the schema version of the documents written.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "Default missing ratings to none, and unmoderated recipes to approved",
+		Up:          defaultRatingsAndStatus,
+	},
+	{
+		Version:     2,
+		Description: "Add the recipe type, so that recipes can share the bucket with other types",
+		Up:          addRecipeType,
+	},
+}
+
+func init() {
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			panic(fmt.Sprintf("recipes: migration %d registered as version %d", i+1, m.Version))
+		}
+	}
+}
+
+// SchemaVersion is the version of the recipe documents written by this package.
+func SchemaVersion() int {
+	return len(migrations)
+}
+
+// Migrations lists the registered migrations.
+func Migrations() []Migration {
+	return migrations
+}
+
+// documentVersion returns the schema version of a raw document, 0 if it has none.
+func documentVersion(doc map[string]interface{}) int {
+	version, _ := doc["schema_version"].(float64)
+	return int(version)
+}
+
+// Migrate runs the pending migrations on a raw document, stamping it with
+// each version reached. It reports whether the document was changed.
+func Migrate(doc map[string]interface{}) (bool, error) {
+	version := documentVersion(doc)
+	for _, m := range migrations[min(version, len(migrations)):] {
+		if err := m.Up(doc); err != nil {
+			return false, fmt.Errorf("migration %d: %s", m.Version, err)
+		}
+		doc["schema_version"] = m.Version
+	}
+	return version < len(migrations), nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// defaultRatingsAndStatus fills in fields of recipes stored before ratings
+// were initialized, or before moderation, which listings treat the same.
+func defaultRatingsAndStatus(doc map[string]interface{}) error {
+	if doc["ratings"] == nil {
+		doc["ratings"] = []interface{}{}
+	}
+	if _, ok := doc["status"]; !ok {
+		doc["status"] = StatusApproved
+	}
+	return nil
+}
+
+// addRecipeType types recipes stored when they were the only typeless documents.
+func addRecipeType(doc map[string]interface{}) error {
+	if _, ok := doc["type"]; !ok {
+		doc["type"] = TypeRecipe
+	}
+	return nil
+}
+
+// recipeDocument has the fields of a Recipe, without its JSON methods.
+type recipeDocument Recipe
+
+type versionedRecipe struct {
+	recipeDocument
+	SchemaVersion int `json:"schema_version"`
+}
+
+// storedRecipe is the stored form of a Recipe: typed, at the current
+// schema version, as a Recipe holds every field of the current schema,
+// whatever it was read from. Only documents written to the bucket carry
+// the type and version.
+type storedRecipe struct {
+	recipeDocument
+	Type          string `json:"type"`
+	SchemaVersion int    `json:"schema_version"`
+}
+
+func (r Recipe) stored() storedRecipe {
+	return storedRecipe{recipeDocument(r), TypeRecipe, SchemaVersion()}
+}
+
+// UnmarshalJSON upgrades documents which have not been migrated yet as
+// they are read; they are stored upgraded when next written. Request
+// bodies have no version either, and are upgraded the same way, which
+// only fills in defaults: their moderation status is set by Moderate.
+func (r *Recipe) UnmarshalJSON(b []byte) error {
+	var doc versionedRecipe
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return err
+	}
+	if doc.SchemaVersion < SchemaVersion() {
+		var fields map[string]interface{}
+		if err := json.Unmarshal(b, &fields); err != nil {
+			return err
+		}
+		if _, err := Migrate(fields); err != nil {
+			return err
+		}
+		upgraded, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		doc = versionedRecipe{}
+		if err := json.Unmarshal(upgraded, &doc); err != nil {
+			return err
+		}
+	}
+	*r = Recipe(doc.recipeDocument)
+	return nil
+}
+
+// The MigrateReport entity is used to report the progress of a migration.
+// Conflicts count documents changed while being migrated, which are left
+// for the next run.
+type MigrateReport struct {
+	Version   int    `json:"version"`
+	Scanned   int    `json:"scanned"`
+	Migrated  int    `json:"migrated"`
+	Conflicts int    `json:"conflicts,omitempty"`
+	Failed    int    `json:"failed,omitempty"`
+	LastID    string `json:"last_id,omitempty"`
+}
+
+// MigrateRecipes upgrades every recipe document below the current schema
+// version, in batches, calling progress after each batch. Only documents
+// which still need migrating are read, so an interrupted run is resumed
+// by running it again.
+func MigrateRecipes(db *Bucket, progress func(MigrateReport)) (*MigrateReport, error) {
+
+	pendingN1ql := "SELECT RAW META(recipe).id FROM " + db.Keyspace() + " AS recipe WHERE " + isRecipe +
+		" AND IFMISSING(recipe.schema_version, 0) < $1 AND META(recipe).id > $2" +
+		" ORDER BY META(recipe).id LIMIT $3"
+	pendingQuery := gocb.NewN1qlQuery(pendingN1ql).AdHoc(false).Consistency(gocb.RequestPlus)
+
+	report := &MigrateReport{Version: SchemaVersion()}
+	for {
+		var params []interface{}
+		params = append(params, report.Version)
+		params = append(params, report.LastID)
+		params = append(params, migrateBatchSize)
+
+		rows, err := db.ExecuteN1qlQuery(pendingQuery, params)
+		if err != nil {
+			return report, err
+		}
+		var ids []string
+		var id string
+		for rows.Next(&id) {
+			ids = append(ids, id)
+		}
+		if err := rows.Close(); err != nil {
+			return report, err
+		}
+		if len(ids) == 0 {
+			return report, nil
+		}
+
+		migrateBatch(db, ids, report)
+		report.LastID = ids[len(ids)-1]
+		if progress != nil {
+			progress(*report)
+		}
+	}
+}
+
+// migrateBatch migrates the documents listed, counting the outcome of each
+func migrateBatch(db *Bucket, ids []string, report *MigrateReport) {
+
+	gets := make([]*gocb.GetOp, len(ids))
+	getOps := make([]gocb.BulkOp, len(ids))
+	for i, id := range ids {
+		gets[i] = &gocb.GetOp{Key: id, Value: &map[string]interface{}{}}
+		getOps[i] = gets[i]
+	}
+	// Per-document errors are checked below
+	db.Do(getOps)
+
+	var replaces []*gocb.ReplaceOp
+	var replaceOps []gocb.BulkOp
+	for _, get := range gets {
+		report.Scanned++
+		if get.Err != nil {
+			// Deleted since it was listed
+			if !gocb.IsKeyNotFoundError(get.Err) {
+				report.Failed++
+			}
+			continue
+		}
+		doc := *get.Value.(*map[string]interface{})
+		changed, err := Migrate(doc)
+		if err != nil {
+			Log.WithError(err).WithField("id", get.Key).Warn("Failed to migrate recipe")
+			report.Failed++
+			continue
+		}
+		if changed {
+			replace := &gocb.ReplaceOp{Key: get.Key, Value: doc, Cas: get.Cas}
+			replaces = append(replaces, replace)
+			replaceOps = append(replaceOps, replace)
+		}
+	}
+	if len(replaceOps) == 0 {
+		return
+	}
+
+	db.Do(replaceOps)
+	for _, replace := range replaces {
+		switch {
+		case replace.Err == nil:
+			report.Migrated++
+		case gocb.IsKeyExistsError(replace.Err), gocb.IsKeyNotFoundError(replace.Err):
+			report.Conflicts++
+		default:
+			report.Failed++
+		}
+	}
+}
@@ -2,6 +2,7 @@ package recipes
 
 import (
 	"strconv"
+	"time"
 
 	// External imports
 	"gopkg.in/couchbase/gocb.v1"
@@ -9,15 +10,29 @@ import (
 
 const (
 	lockTime = 3 // seconds
+
+	// NoPrepTimeLimit is the preptime filter used when none is specified
+	NoPrepTimeLimit = 9999.99 // random large value
 )
 
+// isRecipe is the N1QL condition for recipe documents. Recipes stored
+// before documents had a type are the only untyped objects in the bucket,
+// the counters being plain numbers, and count as recipes until migrated.
+var isRecipe = "(" + RecipeType.Where("recipe") + " OR (ISOBJECT(recipe) AND recipe.type IS MISSING))"
+
 // The Recipe entity is used to marshall/unmarshall JSON.
 type Recipe struct {
-	Name       string  `json:"name"`
-	PrepTime   float32 `json:"preptime"`
-	Difficulty int     `json:"difficulty"`
-	Vegetarian bool    `json:"vegetarian"`
-	Ratings    []int   `json:"ratings"`
+	Name       string   `json:"name"`
+	PrepTime   float32  `json:"preptime"`
+	Difficulty int      `json:"difficulty"`
+	Vegetarian bool     `json:"vegetarian"`
+	Tags       []string `json:"tags,omitempty"`
+	Ratings    []int    `json:"ratings"`
+	// RatedAt holds the times (Unix seconds) of the most recent ratings,
+	// aligned with the tail of Ratings: ratings made before rating times
+	// were recorded have none, so RatedAt may be the shorter of the two.
+	RatedAt []int64 `json:"rated_at,omitempty"`
+	Status  string  `json:"status,omitempty"`
 }
 
 // The N1qlRecipe entity is used to retrieve query data from Couchbase.
@@ -28,12 +43,20 @@ type N1qlRecipe struct {
 
 // The RecipeRated entity is used to marshall/unmarshall JSON.
 type RecipeRated struct {
-	ID         string  `json:"id"`
-	Name       string  `json:"name"`
-	PrepTime   float32 `json:"preptime"`
-	Difficulty int     `json:"difficulty"`
-	Vegetarian bool    `json:"vegetarian"`
-	AvgRating  float32 `json:"avg_rating"`
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	PrepTime    float32  `json:"preptime"`
+	Difficulty  int      `json:"difficulty"`
+	Vegetarian  bool     `json:"vegetarian"`
+	Tags        []string `json:"tags,omitempty"`
+	AvgRating   float32  `json:"avg_rating"`
+	RatingCount int      `json:"rating_count"`
+	Score       float32  `json:"score"`
+	Velocity    float32  `json:"velocity,omitempty"`
+
+	// Full-text search results only
+	Relevance float64             `json:"relevance,omitempty"`
+	Fragments map[string][]string `json:"fragments,omitempty"`
 }
 
 // The RecipeRating entity is used to marshall/unmarshall JSON.
@@ -43,7 +66,7 @@ type RecipeRating struct {
 }
 
 // GetRecipe returns a single specified recipe.
-func (r *Recipe) GetRecipe(id string, db *gocb.Bucket) error {
+func (r *Recipe) GetRecipe(id string, db *Bucket) error {
 	_, err := db.Get(id, r)
 	if err != nil {
 		return err
@@ -53,7 +76,7 @@ func (r *Recipe) GetRecipe(id string, db *gocb.Bucket) error {
 
 // UpdateRecipe is used to modify a specific recipe.
 // The recipe ratings will not be changed.
-func (r *Recipe) UpdateRecipe(id string, db *gocb.Bucket) error {
+func (r *Recipe) UpdateRecipe(id string, db *Bucket) error {
 
 	var recipe Recipe
 
@@ -67,9 +90,16 @@ func (r *Recipe) UpdateRecipe(id string, db *gocb.Bucket) error {
 	recipe.PrepTime = r.PrepTime
 	recipe.Difficulty = r.Difficulty
 	recipe.Vegetarian = r.Vegetarian
+	recipe.Tags = r.Tags
+
+	// Changes which trip the blocklist go back into the moderation queue
+	if r.Status == StatusPending {
+		recipe.Status = StatusPending
+	}
+	r.Status = recipe.Status
 
 	// Mutating unlocks the document
-	_, err = db.Replace(id, recipe, cas, 0)
+	_, err = db.Replace(id, recipe.stored(), cas, 0)
 	if err != nil {
 		return err
 	}
@@ -78,7 +108,7 @@ func (r *Recipe) UpdateRecipe(id string, db *gocb.Bucket) error {
 }
 
 // DeleteRecipe is used to delete a specific recipe.
-func (r *Recipe) DeleteRecipe(id string, db *gocb.Bucket) error {
+func (r *Recipe) DeleteRecipe(id string, db *Bucket) error {
 	_, err := db.Remove(id, 0)
 	if err != nil {
 		return err
@@ -87,21 +117,14 @@ func (r *Recipe) DeleteRecipe(id string, db *gocb.Bucket) error {
 }
 
 // CreateRecipe is used to create a single recipe.
-func (r *Recipe) CreateRecipe(db *gocb.Bucket) error {
+func (r *Recipe) CreateRecipe(db *Bucket) error {
 
-	// For automatically getting the next sequence number:
-	// increment by 1, initialize at 1 if counter not found,
-	// do not expire (set expiry to 0). Returns uint64, Cas, error.
-	newID, _, err := db.Counter("idGeneratorForRecipes", 1, 1, 0)
+	id, err := RecipeType.NextID(db)
 	if err != nil {
 		return err
 	}
 
-	rID := int(newID)
-
-	id := strconv.Itoa(rID)
-
-	_, err = db.Insert(id, r, 0)
+	_, err = db.Insert(RecipeType.Key(id), r.stored(), 0)
 	if err != nil {
 		return err
 	}
@@ -109,9 +132,9 @@ func (r *Recipe) CreateRecipe(db *gocb.Bucket) error {
 }
 
 // GetRecipes returns a collection of known recipes.
-func GetRecipes(db *gocb.Bucket, start int, count int) ([]N1qlRecipe, error) {
+func GetRecipes(db *Bucket, start int, count int) ([]N1qlRecipe, error) {
 
-	getRecipesN1ql := "SELECT META().id, * FROM recipes AS recipe LIMIT $1 OFFSET $2"
+	getRecipesN1ql := "SELECT META().id, * FROM " + db.Keyspace() + " AS recipe WHERE " + visibleRecipe + " LIMIT $1 OFFSET $2"
 	getRecipesQuery := gocb.NewN1qlQuery(getRecipesN1ql).AdHoc(false)
 
 	var params []interface{}
@@ -135,16 +158,27 @@ func GetRecipes(db *gocb.Bucket, start int, count int) ([]N1qlRecipe, error) {
 	return recipes, nil
 }
 
-// GetRecipesRated returns a collection of rated recipes.
-func GetRecipesRated(db *gocb.Bucket, start int, count int, preptime float32) ([]RecipeRated, error) {
+// GetRecipesRated returns a collection of rated recipes,
+// ordered by the specified sort key (if any).
+func GetRecipesRated(db *Bucket, start int, count int, preptime float32, sortBy string, prior RatingPrior) ([]RecipeRated, error) {
 
-	listRecipesN1ql := "SELECT META().id, * FROM recipes AS recipe WHERE preptime < $3 LIMIT $1 OFFSET $2"
+	orderBy, ok := sortOrders[sortBy]
+	if !ok {
+		return nil, ErrInvalidSort
+	}
+	mean, weight := prior.values()
+
+	listRecipesN1ql := "SELECT META().id, * FROM " + db.Keyspace() + " AS recipe WHERE preptime < $3 AND " + visibleRecipe + orderBy + " LIMIT $1 OFFSET $2"
 	listRecipesQuery := gocb.NewN1qlQuery(listRecipesN1ql).AdHoc(false)
 
 	var params []interface{}
 	params = append(params, count)
 	params = append(params, start)
 	params = append(params, preptime)
+	if sortBy == "score" {
+		params = append(params, mean)
+		params = append(params, weight)
+	}
 
 	rows, err := db.ExecuteN1qlQuery(listRecipesQuery, params)
 	if err != nil {
@@ -157,23 +191,7 @@ func GetRecipesRated(db *gocb.Bucket, start int, count int, preptime float32) ([
 	var row N1qlRecipe
 
 	for rows.Next(&row) {
-		recipeRated := RecipeRated{}
-		recipeRated.ID = row.ID
-		recipeRated.Name = row.Recipe.Name
-		recipeRated.PrepTime = row.Recipe.PrepTime
-		recipeRated.Difficulty = row.Recipe.Difficulty
-		recipeRated.Vegetarian = row.Recipe.Vegetarian
-		var avgRating float32
-		lenRatings := len(row.Recipe.Ratings)
-		if lenRatings > 0 {
-			total := 0
-			for _, r := range row.Recipe.Ratings {
-				total += r
-			}
-			avgRating = float32(total) / float32(lenRatings)
-		}
-		recipeRated.AvgRating = avgRating
-		recipesRated = append(recipesRated, recipeRated)
+		recipesRated = append(recipesRated, rated(row, prior))
 		row = N1qlRecipe{}
 	}
 	return recipesRated, nil
@@ -182,7 +200,7 @@ func GetRecipesRated(db *gocb.Bucket, start int, count int, preptime float32) ([
 // AddRecipeRating adds a rating for a specific recipe.
 // There can be many ratings for any specific recipe
 // and the ratings are never overwritten.
-func (rr *RecipeRating) AddRecipeRating(db *gocb.Bucket) error {
+func (rr *RecipeRating) AddRecipeRating(db *Bucket) error {
 
 	id := strconv.Itoa(int(rr.RecipeID))
 
@@ -198,8 +216,16 @@ func (rr *RecipeRating) AddRecipeRating(db *gocb.Bucket) error {
 	ratings = append(ratings, rr.Rating)
 	recipe.Ratings = ratings
 
+	// Rating times drive the trending feed; keep them aligned with the
+	// tail of Ratings, even if a replaced recipe dropped some ratings
+	ratedAt := recipe.RatedAt
+	if extra := len(ratedAt) - (len(ratings) - 1); extra > 0 {
+		ratedAt = ratedAt[extra:]
+	}
+	recipe.RatedAt = append(ratedAt, time.Now().Unix())
+
 	// Mutating unlocks the document
-	_, err = db.Replace(id, recipe, cas, 0)
+	_, err = db.Replace(id, recipe.stored(), cas, 0)
 	if err != nil {
 		return err
 	}
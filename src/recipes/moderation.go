@@ -0,0 +1,138 @@
+package recipes
+
+import (
+	"errors"
+	"strings"
+
+	// External imports
+	"gopkg.in/couchbase/gocb.v1"
+)
+
+// Moderation states for user-submitted content.
+const (
+	StatusPending  = "pending"
+	StatusApproved = "approved"
+	StatusRejected = "rejected"
+)
+
+// visibleRecipe is the N1QL condition for recipes that may be listed.
+// Documents written before moderation was introduced have no status
+// and are treated as approved.
+var visibleRecipe = isRecipe + ` AND (recipe.status IS MISSING OR recipe.status = "approved")`
+
+// visible is the Go equivalent of visibleRecipe.
+func (r Recipe) visible() bool {
+	return r.Status == "" || r.Status == StatusApproved
+}
+
+// ErrInvalidStatus is returned for an unknown moderation status.
+var ErrInvalidStatus = errors.New("invalid moderation status")
+
+// A Blocklist holds the words that cause submitted text to be held for moderation.
+type Blocklist struct {
+	words map[string]bool
+}
+
+// NewBlocklist returns a Blocklist for the specified words (case and accent-insensitive).
+func NewBlocklist(words []string) *Blocklist {
+	bl := &Blocklist{words: make(map[string]bool)}
+	for _, w := range words {
+		w = fold(strings.TrimSpace(w))
+		if w != "" {
+			bl.words[w] = true
+		}
+	}
+	return bl
+}
+
+// Blocked reports whether the text contains any blocked word.
+// A nil Blocklist blocks nothing.
+func (bl *Blocklist) Blocked(text string) bool {
+	if bl == nil || len(bl.words) == 0 {
+		return false
+	}
+	for _, w := range tokenize(text) {
+		if bl.words[w] {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidStatus reports whether status is a known moderation status.
+func ValidStatus(status string) bool {
+	switch status {
+	case StatusPending, StatusApproved, StatusRejected:
+		return true
+	}
+	return false
+}
+
+// Moderate sets the moderation status of a submitted recipe.
+// Recipes containing blocked words are held as pending,
+// anything else is approved.
+func (r *Recipe) Moderate(bl *Blocklist) {
+	if bl.Blocked(r.Name) {
+		r.Status = StatusPending
+	} else {
+		r.Status = StatusApproved
+	}
+}
+
+// SetRecipeStatus is used by moderators to approve or reject a specific recipe.
+func SetRecipeStatus(id string, status string, db *Bucket) (*Recipe, error) {
+
+	if !ValidStatus(status) {
+		return nil, ErrInvalidStatus
+	}
+
+	var recipe Recipe
+
+	// Get document, lock for specified number of seconds
+	cas, err := db.GetAndLock(id, lockTime, &recipe)
+	if err != nil {
+		return nil, err
+	}
+
+	recipe.Status = status
+
+	// Mutating unlocks the document
+	_, err = db.Replace(id, recipe.stored(), cas, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &recipe, nil
+}
+
+// GetModerationQueue returns a collection of recipes with the specified status.
+func GetModerationQueue(db *Bucket, status string, start int, count int) ([]N1qlRecipe, error) {
+
+	if !ValidStatus(status) {
+		return nil, ErrInvalidStatus
+	}
+
+	queueN1ql := "SELECT META().id, * FROM " + db.Keyspace() + " AS recipe WHERE " + isRecipe + " AND recipe.status = $3 LIMIT $1 OFFSET $2"
+	queueQuery := gocb.NewN1qlQuery(queueN1ql).AdHoc(false)
+
+	var params []interface{}
+	params = append(params, count)
+	params = append(params, start)
+	params = append(params, status)
+
+	rows, err := db.ExecuteN1qlQuery(queueQuery, params)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	recipes := []N1qlRecipe{}
+
+	var row N1qlRecipe
+
+	for rows.Next(&row) {
+		recipes = append(recipes, row)
+		row = N1qlRecipe{}
+	}
+	return recipes, nil
+}
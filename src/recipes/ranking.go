@@ -0,0 +1,98 @@
+package recipes
+
+import (
+	"errors"
+)
+
+// A RatingPrior configures the Bayesian average used to rank rated recipes.
+// Every recipe is scored as if it already had Weight ratings of Mean, so a
+// single 5-star rating does not outrank hundreds of 4.8 ratings.
+//
+// A nil Mean or a zero Weight selects the default, so that a configured mean
+// of 0 is honoured.
+type RatingPrior struct {
+	Mean   *float32
+	Weight float32
+}
+
+// The default prior mean and weight.
+const (
+	DefaultPriorMean   = 3
+	DefaultPriorWeight = 5
+)
+
+// ErrInvalidSort is returned for an unknown sort key.
+var ErrInvalidSort = errors.New("invalid sort key")
+
+// scoreN1ql is the N1QL equivalent of RatingPrior.Score,
+// for the specified prior mean and weight parameters.
+func scoreN1ql(mean, weight string) string {
+	return "(" + mean + " * " + weight + " + IFMISSINGORNULL(ARRAY_SUM(recipe.ratings), 0)) / (" +
+		weight + " + IFMISSINGORNULL(ARRAY_LENGTH(recipe.ratings), 0))"
+}
+
+// sortOrders maps the accepted sort keys to their ORDER BY clauses.
+// META().id is included so that pages are stable.
+var sortOrders = map[string]string{
+	"":           "",
+	"score":      " ORDER BY " + scoreN1ql("$4", "$5") + " DESC, META(recipe).id",
+	"avg_rating": " ORDER BY IFMISSINGORNULL(ARRAY_AVG(recipe.ratings), 0) DESC, META(recipe).id",
+	"preptime":   " ORDER BY recipe.preptime, META(recipe).id",
+}
+
+// ValidSort reports whether sortBy is an accepted sort key.
+func ValidSort(sortBy string) bool {
+	_, ok := sortOrders[sortBy]
+	return ok
+}
+
+// values returns the prior mean and weight, falling back to the defaults.
+func (p RatingPrior) values() (mean float32, weight float32) {
+	mean, weight = DefaultPriorMean, DefaultPriorWeight
+	if p.Mean != nil {
+		mean = *p.Mean
+	}
+	if p.Weight > 0 {
+		weight = p.Weight
+	}
+	return mean, weight
+}
+
+// Score returns the Bayesian average of the specified ratings.
+func (p RatingPrior) Score(ratings []int) float32 {
+	mean, weight := p.values()
+	total := 0
+	for _, r := range ratings {
+		total += r
+	}
+	return (mean*weight + float32(total)) / (weight + float32(len(ratings)))
+}
+
+// Rated returns the recipe with the given ID along with its rating summary.
+func (r Recipe) Rated(id string, prior RatingPrior) RecipeRated {
+	return rated(N1qlRecipe{ID: id, Recipe: r}, prior)
+}
+
+// rated converts a query row into a RecipeRated.
+func rated(row N1qlRecipe, prior RatingPrior) RecipeRated {
+	recipeRated := RecipeRated{}
+	recipeRated.ID = row.ID
+	recipeRated.Name = row.Recipe.Name
+	recipeRated.PrepTime = row.Recipe.PrepTime
+	recipeRated.Difficulty = row.Recipe.Difficulty
+	recipeRated.Vegetarian = row.Recipe.Vegetarian
+	recipeRated.Tags = row.Recipe.Tags
+	var avgRating float32
+	lenRatings := len(row.Recipe.Ratings)
+	if lenRatings > 0 {
+		total := 0
+		for _, r := range row.Recipe.Ratings {
+			total += r
+		}
+		avgRating = float32(total) / float32(lenRatings)
+	}
+	recipeRated.AvgRating = avgRating
+	recipeRated.RatingCount = lenRatings
+	recipeRated.Score = prior.Score(row.Recipe.Ratings)
+	return recipeRated
+}
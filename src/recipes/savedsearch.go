@@ -0,0 +1,174 @@
+package recipes
+
+import (
+	"errors"
+	"time"
+
+	// External imports
+	"gopkg.in/couchbase/gocb.v1"
+)
+
+// ErrInvalidSavedSearch is returned for a saved search without a user or with an invalid filter.
+var ErrInvalidSavedSearch = errors.New("a saved search needs a user and a valid filter")
+
+// The SavedSearch entity is used to marshall/unmarshall JSON.
+// Seen holds the IDs of the recipes matched by the last run.
+type SavedSearch struct {
+	ID      string       `json:"id"`
+	User    string       `json:"user"`
+	Name    string       `json:"name,omitempty"`
+	Filter  SearchFilter `json:"filter"`
+	Seen    []string     `json:"seen,omitempty"`
+	LastRun *time.Time   `json:"last_run,omitempty"`
+}
+
+// savedSearchDocument is the stored form of a SavedSearch,
+// typed so that recipe queries skip it.
+type savedSearchDocument struct {
+	Type string `json:"type"`
+	SavedSearch
+}
+
+func (s *SavedSearch) document() savedSearchDocument {
+	return savedSearchDocument{Type: TypeSavedSearch, SavedSearch: *s}
+}
+
+// CreateSavedSearch is used to save a search definition for a user.
+func (s *SavedSearch) CreateSavedSearch(db *Bucket) error {
+
+	if s.User == "" || !ValidSort(s.Filter.Sort) {
+		return ErrInvalidSavedSearch
+	}
+	if s.Filter.PrepTime <= 0 {
+		s.Filter.PrepTime = NoPrepTimeLimit
+	}
+
+	id, err := SavedSearchType.NextID(db)
+	if err != nil {
+		return err
+	}
+
+	s.ID = id
+	s.Seen = nil
+	s.LastRun = nil
+
+	_, err = db.Insert(SavedSearchType.Key(s.ID), s.document(), 0)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetSavedSearch returns a single specified saved search.
+func (s *SavedSearch) GetSavedSearch(id string, db *Bucket) error {
+	_, err := db.Get(SavedSearchType.Key(id), s)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteSavedSearch is used to delete a specific saved search.
+func (s *SavedSearch) DeleteSavedSearch(id string, db *Bucket) error {
+	_, err := db.Remove(SavedSearchType.Key(id), 0)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// RecordRun stores the IDs of the recipes matched by the latest run of a
+// saved search, and returns the IDs which were not matched by the previous run.
+func (s *SavedSearch) RecordRun(id string, matched []string, db *Bucket) ([]string, error) {
+
+	// Get document, lock for specified number of seconds
+	cas, err := db.GetAndLock(SavedSearchType.Key(id), lockTime, s)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for _, recipeID := range s.Seen {
+		seen[recipeID] = true
+	}
+	newIDs := []string{}
+	for _, recipeID := range matched {
+		if !seen[recipeID] {
+			newIDs = append(newIDs, recipeID)
+		}
+	}
+
+	now := time.Now().UTC()
+	s.Seen = matched
+	s.LastRun = &now
+
+	// Mutating unlocks the document
+	_, err = db.Replace(SavedSearchType.Key(id), s.document(), cas, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return newIDs, nil
+}
+
+// GetSavedSearches returns a collection of the searches saved by a user.
+func GetSavedSearches(db *Bucket, user string, start int, count int) ([]SavedSearch, error) {
+
+	getSearchesN1ql := "SELECT RAW search FROM " + db.Keyspace() + " AS search WHERE " + SavedSearchType.Where("search") + " AND search.user = $3" +
+		" ORDER BY TONUMBER(search.id) LIMIT $1 OFFSET $2"
+	getSearchesQuery := gocb.NewN1qlQuery(getSearchesN1ql).AdHoc(false)
+
+	var params []interface{}
+	params = append(params, count)
+	params = append(params, start)
+	params = append(params, user)
+
+	rows, err := db.ExecuteN1qlQuery(getSearchesQuery, params)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	searches := []SavedSearch{}
+
+	var row SavedSearch
+
+	for rows.Next(&row) {
+		searches = append(searches, row)
+		row = SavedSearch{}
+	}
+	return searches, nil
+}
+
+// MatchingRecipeIDs returns the IDs of the first limit visible recipes
+// matching the filter, in order of ID, so that successive runs of a saved
+// search can be compared. For text searches, ids restricts the matches.
+func MatchingRecipeIDs(db *Bucket, filter SearchFilter, ids []string, limit int) ([]string, error) {
+
+	matchingN1ql := "SELECT RAW META(recipe).id FROM " + db.Keyspace() + " AS recipe WHERE recipe.preptime < $2 AND " + visibleRecipe
+	var params []interface{}
+	params = append(params, limit)
+	params = append(params, filter.PrepTime)
+	if ids != nil {
+		matchingN1ql += " AND META(recipe).id IN $3"
+		params = append(params, ids)
+	}
+	matchingN1ql += " ORDER BY META(recipe).id LIMIT $1"
+	matchingQuery := gocb.NewN1qlQuery(matchingN1ql).AdHoc(false)
+
+	rows, err := db.ExecuteN1qlQuery(matchingQuery, params)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	matched := []string{}
+
+	var id string
+
+	for rows.Next(&id) {
+		matched = append(matched, id)
+		id = ""
+	}
+	return matched, nil
+}
@@ -0,0 +1,138 @@
+package recipes
+
+import (
+	"encoding/json"
+
+	// External imports
+	"gopkg.in/couchbase/gocb.v1"
+	"gopkg.in/couchbase/gocb.v1/cbft"
+)
+
+// maxTextMatches limits the number of matches considered by a text search.
+const maxTextMatches = 1000
+
+// A SearchFilter holds the criteria accepted by the search endpoint.
+type SearchFilter struct {
+	Query    string  `json:"q,omitempty"`
+	PrepTime float32 `json:"preptime"`
+	Sort     string  `json:"sort,omitempty"`
+}
+
+// A TextMatch is a recipe which matched a full-text query.
+type TextMatch struct {
+	ID        string
+	Score     float64
+	Fragments map[string][]string
+}
+
+// A TextSearcher finds the visible recipes matching a full-text query,
+// most relevant first.
+type TextSearcher interface {
+	Match(db *Bucket, q string, preptime float32) ([]TextMatch, error)
+}
+
+// FTSSearcher is a TextSearcher backed by a Couchbase full-text index.
+type FTSSearcher struct {
+	Index string
+}
+
+// Match implements TextSearcher.
+func (s FTSSearcher) Match(db *Bucket, q string, preptime float32) ([]TextMatch, error) {
+
+	query := cbft.NewBooleanQuery().
+		Must(cbft.NewConjunctionQuery(
+			cbft.NewMatchQuery(q),
+			cbft.NewNumericRangeQuery().Max(preptime, false).Field("preptime"))).
+		MustNot(cbft.NewDisjunctionQuery(
+			cbft.NewTermQuery(StatusPending).Field("status"),
+			cbft.NewTermQuery(StatusRejected).Field("status")))
+
+	searchQuery := gocb.NewSearchQuery(s.Index, query).
+		Limit(maxTextMatches).
+		Highlight(gocb.HtmlHighlightStyle, "name")
+
+	results, err := db.ExecuteSearchQuery(searchQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := []TextMatch{}
+	for _, hit := range results.Hits() {
+		matches = append(matches, TextMatch{ID: hit.Id, Score: hit.Score, Fragments: hit.Fragments})
+	}
+	return matches, nil
+}
+
+// SearchRecipesText returns a page of the recipes matching a full-text query,
+// ranked by relevance, with highlighted fragments.
+// Matches are checked against the stored recipes before paging, as
+// the text index may lag behind deletions and moderation.
+// The IDs of all of the matching recipes are also returned.
+func SearchRecipesText(db *Bucket, searcher TextSearcher, filter SearchFilter, start int, count int, prior RatingPrior) ([]RecipeRated, []string, error) {
+
+	matches, err := searcher.Match(db, filter.Query, filter.PrepTime)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ids := []string{}
+	for _, m := range matches {
+		ids = append(ids, m.ID)
+	}
+
+	recipesRated := []RecipeRated{}
+	if len(matches) == 0 {
+		return recipesRated, ids, nil
+	}
+
+	var ops []gocb.BulkOp
+	for _, m := range matches {
+		ops = append(ops, &gocb.GetOp{Key: m.ID, Value: &json.RawMessage{}})
+	}
+	if err := db.Do(ops); err != nil {
+		return nil, nil, err
+	}
+
+	for i, op := range ops {
+		getOp := op.(*gocb.GetOp)
+		if getOp.Err != nil {
+			// Deleted since it was indexed
+			if gocb.IsKeyNotFoundError(getOp.Err) {
+				continue
+			}
+			return nil, nil, getOp.Err
+		}
+		recipe, ok := decodeRecipe(*getOp.Value.(*json.RawMessage))
+		if !ok || !recipe.visible() || recipe.PrepTime >= filter.PrepTime {
+			continue
+		}
+		if start > 0 {
+			start--
+			continue
+		}
+		recipeRated := rated(N1qlRecipe{ID: getOp.Key, Recipe: recipe}, prior)
+		recipeRated.Relevance = matches[i].Score
+		recipeRated.Fragments = matches[i].Fragments
+		recipesRated = append(recipesRated, recipeRated)
+		if len(recipesRated) == count {
+			break
+		}
+	}
+	return recipesRated, ids, nil
+}
+
+// decodeRecipe is the Go equivalent of isRecipe: it decodes a document
+// as a Recipe, unless it is some other kind of document.
+func decodeRecipe(raw json.RawMessage) (Recipe, bool) {
+	var recipe Recipe
+	var typed struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(raw, &typed) != nil || (typed.Type != "" && typed.Type != TypeRecipe) {
+		return recipe, false
+	}
+	if json.Unmarshal(raw, &recipe) != nil {
+		return recipe, false
+	}
+	return recipe, true
+}
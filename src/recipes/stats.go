@@ -0,0 +1,138 @@
+package recipes
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	// External imports
+	"gopkg.in/couchbase/gocb.v1"
+)
+
+// Percentiles reported for recipe preparation times.
+var prepTimePercentiles = []int{25, 50, 75, 90, 99}
+
+// The Stats entity is used to report totals and distributions across all recipes.
+type Stats struct {
+	Recipes         int                `json:"recipes"`
+	Vegetarian      int                `json:"vegetarian"`
+	VegetarianShare float32            `json:"vegetarian_share"`
+	Difficulty      map[string]int     `json:"difficulty"`
+	PrepTime        map[string]float32 `json:"preptime_percentiles"`
+	Ratings         int                `json:"ratings"`
+	RatedRecipes    int                `json:"rated_recipes"`
+	AvgRating       float32            `json:"avg_rating"`
+	Generated       time.Time          `json:"generated"`
+}
+
+type statsTotals struct {
+	Recipes      int     `json:"recipes"`
+	Vegetarian   int     `json:"vegetarian"`
+	Timed        int     `json:"timed"`
+	Ratings      int     `json:"ratings"`
+	RatedRecipes int     `json:"rated_recipes"`
+	RatingTotal  float64 `json:"rating_total"`
+}
+
+type difficultyCount struct {
+	Difficulty int `json:"difficulty"`
+	Count      int `json:"count"`
+}
+
+// GetStats returns totals and distributions across all visible recipes.
+// Everything is aggregated by the query service rather than in Go.
+func GetStats(db *Bucket) (*Stats, error) {
+
+	totalsN1ql := "SELECT COUNT(*) AS recipes," +
+		" SUM(CASE WHEN recipe.vegetarian = true THEN 1 ELSE 0 END) AS vegetarian," +
+		" COUNT(recipe.preptime) AS timed," +
+		" SUM(IFMISSINGORNULL(ARRAY_LENGTH(recipe.ratings), 0)) AS ratings," +
+		" SUM(CASE WHEN ARRAY_LENGTH(recipe.ratings) > 0 THEN 1 ELSE 0 END) AS rated_recipes," +
+		" SUM(IFMISSINGORNULL(ARRAY_SUM(recipe.ratings), 0)) AS rating_total" +
+		" FROM " + db.Keyspace() + " AS recipe WHERE " + visibleRecipe
+	totalsQuery := gocb.NewN1qlQuery(totalsN1ql).AdHoc(false)
+
+	rows, err := db.ExecuteN1qlQuery(totalsQuery, nil)
+	if err != nil {
+		return nil, err
+	}
+	var totals statsTotals
+	err = rows.One(&totals)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{
+		Recipes:      totals.Recipes,
+		Vegetarian:   totals.Vegetarian,
+		Difficulty:   make(map[string]int),
+		PrepTime:     make(map[string]float32),
+		Ratings:      totals.Ratings,
+		RatedRecipes: totals.RatedRecipes,
+		Generated:    time.Now().UTC(),
+	}
+	if totals.Recipes > 0 {
+		stats.VegetarianShare = float32(totals.Vegetarian) / float32(totals.Recipes)
+	}
+	if totals.Ratings > 0 {
+		stats.AvgRating = float32(totals.RatingTotal / float64(totals.Ratings))
+	}
+
+	difficultyN1ql := "SELECT recipe.difficulty AS difficulty, COUNT(*) AS count" +
+		" FROM " + db.Keyspace() + " AS recipe WHERE " + visibleRecipe + " GROUP BY recipe.difficulty"
+	difficultyQuery := gocb.NewN1qlQuery(difficultyN1ql).AdHoc(false)
+
+	rows, err = db.ExecuteN1qlQuery(difficultyQuery, nil)
+	if err != nil {
+		return nil, err
+	}
+	var dc difficultyCount
+	for rows.Next(&dc) {
+		stats.Difficulty[strconv.Itoa(dc.Difficulty)] = dc.Count
+		dc = difficultyCount{}
+	}
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+
+	// Nearest-rank percentiles, each fetched by its offset into the sorted preptimes.
+	// Recipes deleted since the totals were counted may leave an offset past
+	// the end, in which case the last preptime found is used.
+	prepTimeN1ql := "SELECT RAW recipe.preptime FROM " + db.Keyspace() + " AS recipe" +
+		" WHERE recipe.preptime IS NOT NULL AND " + visibleRecipe +
+		" ORDER BY recipe.preptime LIMIT 1 OFFSET $1"
+	prepTimeQuery := gocb.NewN1qlQuery(prepTimeN1ql).AdHoc(false)
+
+	var last *float32
+	for _, p := range prepTimePercentiles {
+		if totals.Timed == 0 {
+			break
+		}
+		rank := int(math.Ceil(float64(p)/100*float64(totals.Timed))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+
+		var params []interface{}
+		params = append(params, rank)
+
+		rows, err = db.ExecuteN1qlQuery(prepTimeQuery, params)
+		if err != nil {
+			return nil, err
+		}
+		var preptime float32
+		err = rows.One(&preptime)
+		if err == gocb.ErrNoResults {
+			if last == nil {
+				break
+			}
+			preptime = *last
+		} else if err != nil {
+			return nil, err
+		}
+		last = &preptime
+		stats.PrepTime["p"+strconv.Itoa(p)] = preptime
+	}
+
+	return stats, nil
+}
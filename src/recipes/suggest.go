@@ -0,0 +1,150 @@
+package recipes
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	// External imports
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxSuggestions limits the number of suggestions kept for any prefix.
+const maxSuggestions = 10
+
+// A Suggestion is a recipe name offered for a typed prefix.
+type Suggestion struct {
+	ID    string  `json:"id"`
+	Name  string  `json:"name"`
+	score float32 // ranking only
+}
+
+// NameTrie is an in-process prefix tree of recipe names, used for typeahead
+// suggestions. Each node keeps its best suggestions, so lookups only walk
+// the prefix. It is rebuilt from the bucket once it is older than its TTL.
+type NameTrie struct {
+	ttl   time.Duration
+	prior RatingPrior
+
+	mu        sync.Mutex
+	root      *trieNode
+	refreshed time.Time
+}
+
+type trieNode struct {
+	children map[rune]*trieNode
+	top      []Suggestion
+}
+
+// NewNameTrie returns an empty NameTrie which is refreshed after ttl.
+// Suggestions are ranked by the Bayesian score of their recipes.
+func NewNameTrie(ttl time.Duration, prior RatingPrior) *NameTrie {
+	return &NameTrie{ttl: ttl, prior: prior}
+}
+
+// Suggest returns up to count recipe names in which a word starts with prefix,
+// ignoring case and accents.
+func (nt *NameTrie) Suggest(db *Bucket, prefix string, count int) ([]Suggestion, error) {
+
+	nt.mu.Lock()
+	defer nt.mu.Unlock()
+
+	if nt.root == nil || time.Since(nt.refreshed) > nt.ttl {
+		if err := nt.refresh(db); err != nil {
+			return nil, err
+		}
+	}
+
+	suggestions := []Suggestion{}
+	key := strings.Join(tokenize(prefix), " ")
+	if key == "" {
+		return suggestions, nil
+	}
+	// Keep a trailing space, so that "pea " does not suggest "Peach"
+	if strings.HasSuffix(prefix, " ") {
+		key += " "
+	}
+
+	node := nt.root
+	for _, c := range key {
+		if node = node.children[c]; node == nil {
+			return suggestions, nil
+		}
+	}
+	if count > len(node.top) {
+		count = len(node.top)
+	}
+	return append(suggestions, node.top[:count]...), nil
+}
+
+// refresh rebuilds the trie from every visible recipe in the bucket.
+func (nt *NameTrie) refresh(db *Bucket) error {
+
+	root := &trieNode{}
+
+	err := forEachRecipe(db, visibleRecipe, func(row N1qlRecipe) error {
+		s := Suggestion{ID: row.ID, Name: row.Recipe.Name, score: nt.prior.Score(row.Recipe.Ratings)}
+		words := tokenize(row.Recipe.Name)
+		// Index the name from the start of every word
+		for i := range words {
+			root.insert(strings.Join(words[i:], " "), s)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	nt.root = root
+	nt.refreshed = time.Now()
+	return nil
+}
+
+func (n *trieNode) insert(key string, s Suggestion) {
+	n.offer(s)
+	for _, c := range key {
+		if n.children == nil {
+			n.children = make(map[rune]*trieNode)
+		}
+		child := n.children[c]
+		if child == nil {
+			child = &trieNode{}
+			n.children[c] = child
+		}
+		child.offer(s)
+		n = child
+	}
+}
+
+// offer adds s to the best suggestions of the node, if it ranks highly enough.
+func (n *trieNode) offer(s Suggestion) {
+	for _, t := range n.top {
+		if t.ID == s.ID {
+			return
+		}
+	}
+	n.top = append(n.top, s)
+	sort.Slice(n.top, func(i, j int) bool {
+		if n.top[i].score != n.top[j].score {
+			return n.top[i].score > n.top[j].score
+		}
+		return n.top[i].Name < n.top[j].Name
+	})
+	if len(n.top) > maxSuggestions {
+		n.top = n.top[:maxSuggestions]
+	}
+}
+
+// fold lower-cases text and strips any accents, so that "Crème" matches "creme".
+func fold(text string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	folded, _, err := transform.String(t, text)
+	if err != nil {
+		folded = text
+	}
+	return strings.ToLower(folded)
+}
@@ -0,0 +1,93 @@
+package recipes
+
+import (
+	"errors"
+	"regexp"
+	"time"
+
+	// External imports
+	"gopkg.in/couchbase/gocb.v1"
+)
+
+// ErrInvalidTenant is returned for a tenant whose ID is not usable in a bucket name.
+var ErrInvalidTenant = errors.New("a tenant ID needs 1 to 32 lower case letters, digits or dashes, starting with a letter or digit")
+
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// The Tenant entity is used to marshall/unmarshall JSON. A tenant's
+// recipes, searches and ID counters are kept in a bucket of their own;
+// the tenants themselves are kept in the default bucket. SearchIndex
+// names the Couchbase full-text index of the tenant's bucket, if empty
+// an in-process index is used instead.
+type Tenant struct {
+	ID          string    `json:"id"`
+	Bucket      string    `json:"bucket"`
+	Hosts       []string  `json:"hosts,omitempty"`
+	SearchIndex string    `json:"search_index,omitempty"`
+	Created     time.Time `json:"created"`
+}
+
+// tenantDocument is the stored form of a Tenant,
+// typed so that recipe queries skip it.
+type tenantDocument struct {
+	Type string `json:"type"`
+	Tenant
+}
+
+func (t *Tenant) document() tenantDocument {
+	return tenantDocument{Type: TypeTenant, Tenant: *t}
+}
+
+// ValidTenantID reports whether id may identify a tenant.
+func ValidTenantID(id string) bool {
+	return tenantIDPattern.MatchString(id)
+}
+
+// CreateTenant is used to register a tenant, whose bucket must exist.
+func (t *Tenant) CreateTenant(db *Bucket) error {
+
+	if !ValidTenantID(t.ID) || t.Bucket == "" {
+		return ErrInvalidTenant
+	}
+
+	t.Created = time.Now().UTC()
+
+	_, err := db.Insert(TenantType.Key(t.ID), t.document(), 0)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetTenant returns a single specified tenant.
+func (t *Tenant) GetTenant(id string, db *Bucket) error {
+	_, err := db.Get(TenantType.Key(id), t)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetTenants returns every tenant.
+func GetTenants(db *Bucket) ([]Tenant, error) {
+
+	getTenantsN1ql := "SELECT RAW tenant FROM " + db.Keyspace() + " AS tenant WHERE " + TenantType.Where("tenant") + " ORDER BY tenant.id"
+	getTenantsQuery := gocb.NewN1qlQuery(getTenantsN1ql).AdHoc(false).Consistency(gocb.RequestPlus)
+
+	rows, err := db.ExecuteN1qlQuery(getTenantsQuery, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	tenants := []Tenant{}
+	var row Tenant
+
+	for rows.Next(&row) {
+		tenants = append(tenants, row)
+		row = Tenant{}
+	}
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+	return tenants, nil
+}
@@ -0,0 +1,197 @@
+package recipes
+
+import (
+	"html"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	// External imports
+	"gopkg.in/couchbase/gocb.v1"
+)
+
+// TextIndex is an in-process inverted index over recipe names, for use
+// where no Couchbase full-text index is available (the Community Edition
+// set up by docker-compose does not run the search service).
+// It is rebuilt from the bucket once it is older than its TTL.
+type TextIndex struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	postings  map[string]map[string]int // term -> recipe ID -> term frequency
+	recipes   map[string]Recipe
+	refreshed time.Time
+}
+
+// NewTextIndex returns an empty TextIndex which is refreshed after ttl.
+func NewTextIndex(ttl time.Duration) *TextIndex {
+	return &TextIndex{ttl: ttl}
+}
+
+// Match implements TextSearcher. Every term of the query must match.
+func (ix *TextIndex) Match(db *Bucket, q string, preptime float32) ([]TextMatch, error) {
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if ix.recipes == nil || time.Since(ix.refreshed) > ix.ttl {
+		if err := ix.refresh(db); err != nil {
+			return nil, err
+		}
+	}
+
+	terms := make(map[string]bool)
+	for _, term := range tokenize(q) {
+		terms[term] = true
+	}
+
+	scores := make(map[string]float64)
+	first := true
+	for term := range terms {
+		postings := ix.postings[term]
+		idf := math.Log(1 + float64(len(ix.recipes))/float64(1+len(postings)))
+		next := make(map[string]float64)
+		for id, tf := range postings {
+			if score, ok := scores[id]; ok || first {
+				next[id] = score + float64(tf)*idf
+			}
+		}
+		scores = next
+		first = false
+	}
+
+	matches := []TextMatch{}
+	for id, score := range scores {
+		recipe := ix.recipes[id]
+		if recipe.PrepTime >= preptime {
+			continue
+		}
+		matches = append(matches, TextMatch{
+			ID:        id,
+			Score:     score,
+			Fragments: map[string][]string{"name": {highlight(recipe.Name, terms)}},
+		})
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score > matches[j].Score
+		}
+		return matches[i].ID < matches[j].ID
+	})
+	if len(matches) > maxTextMatches {
+		matches = matches[:maxTextMatches]
+	}
+	return matches, nil
+}
+
+// refresh rebuilds the index from every visible recipe in the bucket.
+func (ix *TextIndex) refresh(db *Bucket) error {
+
+	postings := make(map[string]map[string]int)
+	recipes := make(map[string]Recipe)
+
+	err := forEachRecipe(db, visibleRecipe, func(row N1qlRecipe) error {
+		recipes[row.ID] = row.Recipe
+		for _, term := range tokenize(row.Recipe.Name) {
+			if postings[term] == nil {
+				postings[term] = make(map[string]int)
+			}
+			postings[term][row.ID]++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ix.postings = postings
+	ix.recipes = recipes
+	ix.refreshed = time.Now()
+	return nil
+}
+
+// scanBatchSize is the number of documents read by each query of a scan:
+// gocb buffers the whole result of a query, so scans page through the
+// bucket by key rather than reading it with a single query.
+const scanBatchSize = 500
+
+// forEachRecipe streams every recipe in the bucket which meets the N1QL
+// condition, in key order, stopping at the first error returned by fn.
+func forEachRecipe(db *Bucket, condition string, fn func(N1qlRecipe) error) error {
+
+	allRecipesN1ql := "SELECT META(recipe).id, * FROM " + db.Keyspace() + " AS recipe WHERE (" + condition + ")" +
+		" AND META(recipe).id > $1 ORDER BY META(recipe).id LIMIT $2"
+	allRecipesQuery := gocb.NewN1qlQuery(allRecipesN1ql).AdHoc(false)
+
+	lastID := ""
+	for {
+		var params []interface{}
+		params = append(params, lastID)
+		params = append(params, scanBatchSize)
+
+		rows, err := db.ExecuteN1qlQuery(allRecipesQuery, params)
+		if err != nil {
+			return err
+		}
+
+		var row N1qlRecipe
+		n := 0
+
+		for rows.Next(&row) {
+			if err := fn(row); err != nil {
+				rows.Close()
+				return err
+			}
+			lastID = row.ID
+			n++
+			row = N1qlRecipe{}
+		}
+		if err := rows.Close(); err != nil {
+			return err
+		}
+		if n < scanBatchSize {
+			return nil
+		}
+	}
+}
+
+// isSeparator reports whether c separates the words of some text.
+func isSeparator(c rune) bool {
+	return !unicode.IsLetter(c) && !unicode.IsNumber(c)
+}
+
+// tokenize splits text into lower-case words, without accents.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(fold(text), isSeparator)
+}
+
+// highlight marks up the words of text which are in terms as HTML.
+func highlight(text string, terms map[string]bool) string {
+	var sb strings.Builder
+	word := -1
+	flush := func(end int) {
+		if word < 0 {
+			return
+		}
+		w := text[word:end]
+		if terms[fold(w)] {
+			sb.WriteString("<mark>" + html.EscapeString(w) + "</mark>")
+		} else {
+			sb.WriteString(html.EscapeString(w))
+		}
+		word = -1
+	}
+	for i, c := range text {
+		if isSeparator(c) {
+			flush(i)
+			sb.WriteString(html.EscapeString(string(c)))
+		} else if word < 0 {
+			word = i
+		}
+	}
+	flush(len(text))
+	return sb.String()
+}
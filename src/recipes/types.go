@@ -0,0 +1,88 @@
+package recipes
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Document types. Every document in the bucket names its type in its type
+// field, except the counters, which are plain numbers.
+const (
+	// TypeRecipe is the type of recipe documents
+	TypeRecipe = "recipe"
+
+	// TypeSavedSearch is the type of saved search documents
+	TypeSavedSearch = "savedsearch"
+
+	// TypeTenant is the type of tenant documents
+	TypeTenant = "tenant"
+)
+
+// An EntityType is a kind of document sharing the bucket. Its documents
+// are keyed by an ID, generated by its counter if it has one, after its
+// key prefix, so that the keys of different types cannot collide.
+type EntityType struct {
+	Name      string
+	KeyPrefix string
+	Counter   string
+}
+
+// Registered entity types. Recipes were stored before there were other
+// types, and keep their unprefixed keys.
+var (
+	RecipeType      = RegisterType(EntityType{Name: TypeRecipe, Counter: "idGeneratorForRecipes"})
+	SavedSearchType = RegisterType(EntityType{Name: TypeSavedSearch, KeyPrefix: "search::", Counter: "idGeneratorForSearches"})
+	TenantType      = RegisterType(EntityType{Name: TypeTenant, KeyPrefix: "tenant::"})
+)
+
+var entityTypes []EntityType
+
+// RegisterType adds an entity type to the bucket. It panics if the type's
+// name, key prefix or counter is already used by another type.
+func RegisterType(t EntityType) EntityType {
+	if t.Name == "" {
+		panic("recipes: an entity type needs a name")
+	}
+	for _, other := range entityTypes {
+		if t.Name == other.Name || t.KeyPrefix == other.KeyPrefix || t.Counter != "" && t.Counter == other.Counter {
+			panic(fmt.Sprintf("recipes: entity type %q clashes with %q", t.Name, other.Name))
+		}
+	}
+	entityTypes = append(entityTypes, t)
+	return t
+}
+
+// Counters lists the counters of the registered entity types.
+func Counters() []string {
+	var counters []string
+	for _, t := range entityTypes {
+		if t.Counter != "" {
+			counters = append(counters, t.Counter)
+		}
+	}
+	return counters
+}
+
+// Key returns the document key of an entity.
+func (t EntityType) Key(id string) string {
+	return t.KeyPrefix + id
+}
+
+// NextID reserves the next ID of an entity type.
+func (t EntityType) NextID(db *Bucket) (string, error) {
+	if t.Counter == "" {
+		return "", fmt.Errorf("recipes: entity type %q has no counter", t.Name)
+	}
+	// Increment by 1, initialize at 1 if the counter is not found, do not expire
+	newID, _, err := db.Counter(t.Counter, 1, 1, 0)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(newID, 10), nil
+}
+
+// Where returns the N1QL condition for documents of an entity type, given
+// the alias of the keyspace.
+func (t EntityType) Where(alias string) string {
+	return alias + ".type = \"" + t.Name + "\""
+}
@@ -2,34 +2,47 @@ package main
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"log"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
-	// local import
-	"application"
+	// local imports
+	"restful_couchbase/application"
+	"restful_couchbase/recipes"
 	// external import
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"gopkg.in/couchbase/gocb.v1"
 )
 
 const (
-	sleepTime = 7 // seconds
+	sleepTime  = 7 // seconds
+	adminToken = "admin token"
 )
 
 var app application.App
 
 func TestMain(m *testing.M) {
-	app = application.App{}
+	app = application.App{AdminToken: adminToken}
+	app.Blocklist = recipes.NewBlocklist([]string{"yuck"})
 	app.Initialize(
 		os.Getenv("COUCHBASE_USER"),
 		os.Getenv("COUCHBASE_PASS"),
 		os.Getenv("COUCHBASE_DB"))
-	ensureTablesExist()
+	if err := app.WaitReady(time.Minute); err != nil {
+		log.Fatal(err)
+	}
 	code := m.Run()
 	clearTables()
 	os.Exit(code)
@@ -333,13 +346,6 @@ func checkResponseCode(t *testing.T, expected int, response *httptest.ResponseRe
 	}
 }
 
-func ensureTablesExist() {
-	err := app.Manager.CreatePrimaryIndex("", true, false)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
 func clearTables() {
 	if err := app.Manager.Flush(); err != nil {
 		log.Fatal(err)
@@ -542,13 +548,1301 @@ func TestSearch(t *testing.T) {
 	}
 }
 
+func TestRatingPriorZeroMean(t *testing.T) {
+	var zero float32
+	prior := recipes.RatingPrior{Mean: &zero, Weight: 2}
+	if score := prior.Score([]int{4, 4}); score != 2 {
+		t.Errorf("Expected a score of '2' with a prior mean of 0. Got '%v'", score)
+	}
+	if score := (recipes.RatingPrior{}).Score(nil); score != recipes.DefaultPriorMean {
+		t.Errorf("Expected the default prior mean with no ratings. Got '%v'", score)
+	}
+}
+
+func TestSearchSortByScore(t *testing.T) {
+	clearTables()
+	addRecipes(1, 2)
+
+	// One 5-star rating for recipe 1, five 4-star ratings for recipe 2
+	ratings := map[string][]string{"1": {"5"}, "2": {"4", "4", "4", "4", "4"}}
+	for id, rr := range ratings {
+		for _, rating := range rr {
+			payload := []byte(`{"rating":` + rating + `}`)
+			req, err := http.NewRequest("POST", "/v1/recipes/"+id+"/rating", bytes.NewBuffer(payload))
+			if err != nil {
+				t.Errorf("Error on http.NewRequest (POST): %s", err)
+			}
+			response := executeRequest(req)
+			checkResponseCode(t, http.StatusCreated, response)
+		}
+	}
+
+	// Sleep the specified number of seconds to allow Couchbase time to commit
+	time.Sleep(sleepTime * time.Second)
+
+	expected := map[string]string{"score": "2", "avg_rating": "1"}
+	for sortBy, id := range expected {
+		var bb bytes.Buffer
+		mw := multipart.NewWriter(&bb)
+		mw.WriteField("sort", sortBy)
+		mw.Close()
+
+		req, err := http.NewRequest("POST", "/v1/recipes/search", &bb)
+		if err != nil {
+			t.Errorf("Error on http.NewRequest (POST search): %s", err)
+		}
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response)
+
+		var mm []map[string]interface{}
+		json.Unmarshal(response.Body.Bytes(), &mm)
+		if len(mm) != 2 {
+			t.Errorf("Expected '2' recipes. Got '%v'", len(mm))
+		} else if mm[0]["id"] != id {
+			t.Errorf("Expected recipe '%s' first when sorted by %s. Got '%v'", id, sortBy, mm[0]["id"])
+		}
+	}
+
+	var bb bytes.Buffer
+	mw := multipart.NewWriter(&bb)
+	mw.WriteField("sort", "bogus")
+	mw.Close()
+
+	req, err := http.NewRequest("POST", "/v1/recipes/search", &bb)
+	if err != nil {
+		t.Errorf("Error on http.NewRequest (POST search): %s", err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response)
+}
+
+func TestFeeds(t *testing.T) {
+	clearTables()
+	addRecipes(1, 3)
+
+	payload := []byte(`{"rating":5}`)
+
+	req, err := http.NewRequest("POST", "/v1/recipes/2/rating", bytes.NewBuffer(payload))
+	if err != nil {
+		t.Errorf("Error on http.NewRequest (POST): %s", err)
+	}
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response)
+
+	// Sleep the specified number of seconds to allow Couchbase time to commit
+	time.Sleep(sleepTime * time.Second)
+
+	feeds := []struct {
+		path  string
+		count int
+		first string
+	}{
+		{"/v1/recipes/top", 1, "2"},
+		{"/v1/recipes/trending", 1, "2"},
+		{"/v1/recipes/new", 3, "3"},
+	}
+	for _, feed := range feeds {
+		req, err := http.NewRequest("GET", feed.path, nil)
+		if err != nil {
+			t.Errorf("Error on http.NewRequest (GET %s): %s", feed.path, err)
+		}
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response)
+
+		var mm []map[string]interface{}
+		json.Unmarshal(response.Body.Bytes(), &mm)
+		if len(mm) != feed.count {
+			t.Errorf("Expected '%d' recipes from %s. Got '%v'", feed.count, feed.path, len(mm))
+		} else if mm[0]["id"] != feed.first {
+			t.Errorf("Expected recipe '%s' first from %s. Got '%v'", feed.first, feed.path, mm[0]["id"])
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	clearTables()
+	addRecipes(1, 3)
+
+	// Sleep the specified number of seconds to allow Couchbase time to commit
+	time.Sleep(sleepTime * time.Second)
+
+	req, err := http.NewRequest("GET", "/v1/stats", nil)
+	if err != nil {
+		t.Errorf("Error on http.NewRequest (GET): %s", err)
+	}
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response)
+
+	var stats recipes.Stats
+	json.Unmarshal(response.Body.Bytes(), &stats)
+
+	if stats.Recipes != 3 {
+		t.Errorf("Expected '3' recipes. Got '%v'", stats.Recipes)
+	}
+	if stats.VegetarianShare != 1.0 {
+		t.Errorf("Expected vegetarian share to be '1'. Got '%v'", stats.VegetarianShare)
+	}
+	if stats.Difficulty["2"] != 1 {
+		t.Errorf("Expected '1' recipe of difficulty 2. Got '%v'", stats.Difficulty["2"])
+	}
+	if stats.PrepTime["p50"] != 20.0 {
+		t.Errorf("Expected median preptime to be '20'. Got '%v'", stats.PrepTime["p50"])
+	}
+}
+
+func TestTextSearch(t *testing.T) {
+	clearTables()
+
+	for _, payload := range [][]byte{
+		[]byte(`{"name":"Vegetable Lasagne","preptime":60.0,"difficulty":3,"vegetarian":true}`),
+		[]byte(`{"name":"Beef Lasagne","preptime":90.0,"difficulty":3,"vegetarian":false}`),
+		[]byte(`{"name":"Pea Soup","preptime":30.0,"difficulty":1,"vegetarian":true}`),
+	} {
+		req, err := http.NewRequest("POST", "/v1/recipes", bytes.NewBuffer(payload))
+		if err != nil {
+			t.Errorf("Error on http.NewRequest (POST): %s", err)
+		}
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusCreated, response)
+	}
+
+	// Sleep the specified number of seconds to allow Couchbase time to commit
+	time.Sleep(sleepTime * time.Second)
+
+	searches := []struct {
+		q        string
+		preptime string
+		count    int
+	}{
+		{"lasagne", "", 2},
+		{"vegetable lasagne", "", 1},
+		{"LASAGNE", "75", 1},
+		{"trifle", "", 0},
+	}
+	for _, search := range searches {
+		var bb bytes.Buffer
+		mw := multipart.NewWriter(&bb)
+		mw.WriteField("q", search.q)
+		if search.preptime != "" {
+			mw.WriteField("preptime", search.preptime)
+		}
+		mw.Close()
+
+		req, err := http.NewRequest("POST", "/v1/recipes/search", &bb)
+		if err != nil {
+			t.Errorf("Error on http.NewRequest (POST search): %s", err)
+		}
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response)
+
+		var rr []recipes.RecipeRated
+		json.Unmarshal(response.Body.Bytes(), &rr)
+		if len(rr) != search.count {
+			t.Errorf("Expected '%d' recipes for '%s'. Got '%v'", search.count, search.q, len(rr))
+			continue
+		}
+		if len(rr) > 0 && !strings.Contains(rr[0].Fragments["name"][0], "<mark>Lasagne</mark>") {
+			t.Errorf("Expected a highlighted fragment for '%s'. Got '%v'", search.q, rr[0].Fragments)
+		}
+	}
+}
+
+func TestSearchFacets(t *testing.T) {
+	clearTables()
+
+	payload := []byte(`{"name":"Chili","preptime":45.0,"difficulty":2,"vegetarian":false,"tags":["spicy","mexican"]}`)
+
+	req, err := http.NewRequest("POST", "/v1/recipes", bytes.NewBuffer(payload))
+	if err != nil {
+		t.Errorf("Error on http.NewRequest (POST): %s", err)
+	}
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response)
+
+	addRecipes(2, 3)
+
+	// Sleep the specified number of seconds to allow Couchbase time to commit
+	time.Sleep(sleepTime * time.Second)
+
+	var bb bytes.Buffer
+	mw := multipart.NewWriter(&bb)
+	mw.WriteField("facets", "true")
+	mw.WriteField("count", "2")
+	mw.Close()
+
+	req, err = http.NewRequest("POST", "/v1/recipes/search", &bb)
+	if err != nil {
+		t.Errorf("Error on http.NewRequest (POST search): %s", err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response)
+
+	var results struct {
+		Results []recipes.RecipeRated `json:"results"`
+		Facets  recipes.Facets        `json:"facets"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &results)
+
+	if len(results.Results) != 2 {
+		t.Errorf("Expected a page of '2' recipes. Got '%v'", len(results.Results))
+	}
+	facets := []struct {
+		name      string
+		got, want int
+	}{
+		{"vegetarian true", results.Facets.Vegetarian["true"], 3},
+		{"vegetarian false", results.Facets.Vegetarian["false"], 1},
+		{"difficulty 2", results.Facets.Difficulty["2"], 2},
+		{"preptime <15", results.Facets.PrepTime["<15"], 1},
+		{"preptime 15-30", results.Facets.PrepTime["15-30"], 1},
+		{"preptime 30-60", results.Facets.PrepTime["30-60"], 2},
+		{"tag spicy", results.Facets.Tags["spicy"], 1},
+	}
+	for _, facet := range facets {
+		if facet.got != facet.want {
+			t.Errorf("Expected facet '%s' to be '%d'. Got '%d'", facet.name, facet.want, facet.got)
+		}
+	}
+
+	// The facets of a text search only count the matching recipes
+	bb.Reset()
+	mw = multipart.NewWriter(&bb)
+	mw.WriteField("facets", "true")
+	mw.WriteField("q", "chili")
+	mw.Close()
+
+	req, err = http.NewRequest("POST", "/v1/recipes/search", &bb)
+	if err != nil {
+		t.Errorf("Error on http.NewRequest (POST text search): %s", err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response)
+
+	results.Facets = recipes.Facets{}
+	json.Unmarshal(response.Body.Bytes(), &results)
+
+	facets = []struct {
+		name      string
+		got, want int
+	}{
+		{"vegetarian true", results.Facets.Vegetarian["true"], 0},
+		{"vegetarian false", results.Facets.Vegetarian["false"], 1},
+		{"preptime 30-60", results.Facets.PrepTime["30-60"], 1},
+		{"tag mexican", results.Facets.Tags["mexican"], 1},
+	}
+	for _, facet := range facets {
+		if facet.got != facet.want {
+			t.Errorf("Expected facet '%s' of the text search to be '%d'. Got '%d'", facet.name, facet.want, facet.got)
+		}
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	clearTables()
+
+	for _, payload := range [][]byte{
+		[]byte(`{"name":"Crème Brûlée","preptime":45.0,"difficulty":3,"vegetarian":true}`),
+		[]byte(`{"name":"Creamed Spinach","preptime":20.0,"difficulty":1,"vegetarian":true}`),
+		[]byte(`{"name":"Beef Stew","preptime":120.0,"difficulty":2,"vegetarian":false}`),
+	} {
+		req, err := http.NewRequest("POST", "/v1/recipes", bytes.NewBuffer(payload))
+		if err != nil {
+			t.Errorf("Error on http.NewRequest (POST): %s", err)
+		}
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusCreated, response)
+	}
+
+	// Sleep the specified number of seconds to allow Couchbase time to commit
+	time.Sleep(sleepTime * time.Second)
+
+	prefixes := map[string]int{"cre": 2, "BRU": 1, "creme b": 1, "stew": 1, "x": 0}
+	for prefix, count := range prefixes {
+		req, err := http.NewRequest("GET", "/v1/recipes/suggest?prefix="+url.QueryEscape(prefix), nil)
+		if err != nil {
+			t.Errorf("Error on http.NewRequest (GET): %s", err)
+		}
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response)
+
+		var suggestions []recipes.Suggestion
+		json.Unmarshal(response.Body.Bytes(), &suggestions)
+		if len(suggestions) != count {
+			t.Errorf("Expected '%d' suggestions for '%s'. Got '%v'", count, prefix, suggestions)
+		}
+	}
+}
+
+func TestSavedSearch(t *testing.T) {
+	clearTables()
+	addRecipes(1, 2)
+
+	payload := []byte(`{"user":"alice","name":"quick","filter":{"preptime":50}}`)
+
+	req, err := http.NewRequest("POST", "/v1/searches", bytes.NewBuffer(payload))
+	if err != nil {
+		t.Errorf("Error on http.NewRequest (POST): %s", err)
+	}
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response)
+
+	var saved recipes.SavedSearch
+	json.Unmarshal(response.Body.Bytes(), &saved)
+
+	var created map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &created)
+	if _, ok := created["type"]; ok {
+		t.Errorf("Expected no internal 'type' in the saved search. Got '%v'", created["type"])
+	}
+
+	// Sleep the specified number of seconds to allow Couchbase time to commit
+	time.Sleep(sleepTime * time.Second)
+
+	req, err = http.NewRequest("GET", "/v1/searches?user=alice", nil)
+	if err != nil {
+		t.Errorf("Error on http.NewRequest (GET): %s", err)
+	}
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response)
+
+	var searches []recipes.SavedSearch
+	json.Unmarshal(response.Body.Bytes(), &searches)
+	if len(searches) != 1 {
+		t.Errorf("Expected '1' saved search. Got '%v'", len(searches))
+	}
+
+	for run, expected := range []int{2, 0, 1} {
+		if run == 2 {
+			addRecipes(3, 1)
+
+			// Sleep the specified number of seconds to allow Couchbase time to commit
+			time.Sleep(sleepTime * time.Second)
+		}
+
+		req, err = http.NewRequest("GET", "/v1/searches/"+saved.ID+"/results", nil)
+		if err != nil {
+			t.Errorf("Error on http.NewRequest (GET results): %s", err)
+		}
+		response = executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response)
+
+		var m map[string]interface{}
+		json.Unmarshal(response.Body.Bytes(), &m)
+		if m["new_count"] != float64(expected) {
+			t.Errorf("Expected '%d' new matches on run %d. Got '%v'", expected, run+1, m["new_count"])
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	clearTables()
+
+	payload := []byte(`{"name":"test recipe","preptime":0.1,"difficulty":2,"vegetarian":true}`)
+
+	req, err := http.NewRequest("POST", "/v1/recipes", bytes.NewBuffer(payload))
+	if err != nil {
+		t.Errorf("Error on http.NewRequest (POST): %s", err)
+	}
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response)
+
+	payload = []byte(`[
+		{"op":"create","recipe":{"name":"batch recipe 1","preptime":10,"difficulty":1,"vegetarian":true}},
+		{"op":"create","recipe":{"name":"batch recipe 2","preptime":20,"difficulty":2,"vegetarian":false}},
+		{"op":"update","id":"1","recipe":{"name":"test recipe - batch","preptime":0.2,"difficulty":3,"vegetarian":true}},
+		{"op":"delete","id":"99"},
+		{"op":"create","recipe":{"preptime":30,"difficulty":3}},
+		{"op":"delete","id":"idGeneratorForRecipes"},
+		{"op":"update","id":"search::1","recipe":{"name":"not a recipe","preptime":1,"difficulty":1}}
+	]`)
+
+	req, err = http.NewRequest("POST", "/v1/recipes:batch", bytes.NewBuffer(payload))
+	if err != nil {
+		t.Errorf("Error on http.NewRequest (POST batch): %s", err)
+	}
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusMultiStatus, response)
+
+	var results []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &results)
+
+	expected := []struct {
+		status float64
+		id     string
+	}{
+		{201, "2"},
+		{201, "3"},
+		{200, "1"},
+		{404, "99"},
+		{400, ""},
+		{400, "idGeneratorForRecipes"},
+		{400, "search::1"},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("Expected '%d' results. Got '%v'", len(expected), len(results))
+	}
+	for i, e := range expected {
+		if results[i]["status"] != e.status {
+			t.Errorf("Expected status '%v' for operation %d. Got '%v'", e.status, i, results[i]["status"])
+		}
+		if e.id != "" && results[i]["id"] != e.id {
+			t.Errorf("Expected id '%s' for operation %d. Got '%v'", e.id, i, results[i]["id"])
+		}
+	}
+
+	req, err = http.NewRequest("GET", "/v1/recipes/3", nil)
+	if err != nil {
+		t.Errorf("Error on http.NewRequest (GET): %s", err)
+	}
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response)
+}
+
+func TestImport(t *testing.T) {
+	clearTables()
+
+	csv := "Title,Minutes,difficulty,vegetarian,tags\n" +
+		"Pancakes,20,1,yes,breakfast;sweet\n" +
+		",10,1,no,\n" +
+		"Omelette,ten,1,yes,\n" +
+		"Porridge,5,1,yes,breakfast\n"
+	mapping := url.QueryEscape("Title=name,Minutes=preptime")
+
+	imports := []struct {
+		query    string
+		read     int
+		imported int
+		failed   int
+	}{
+		{"dry_run=true", 4, 2, 2},
+		{"resume=4", 2, 1, 1},
+	}
+	for _, imp := range imports {
+		req, err := http.NewRequest("POST", "/v1/import?map="+mapping+"&"+imp.query, strings.NewReader(csv))
+		if err != nil {
+			t.Errorf("Error on http.NewRequest (POST): %s", err)
+		}
+		req.Header.Set("Content-Type", "text/csv")
+
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response)
+
+		var report recipes.ImportReport
+		json.Unmarshal(response.Body.Bytes(), &report)
+		if report.Read != imp.read || report.Imported != imp.imported || report.Failed != imp.failed {
+			t.Errorf("Expected %d read, %d imported and %d failed for %s. Got %+v", imp.read, imp.imported, imp.failed, imp.query, report)
+		}
+	}
+
+	req, err := http.NewRequest("GET", "/v1/recipes/1", nil)
+	if err != nil {
+		t.Errorf("Error on http.NewRequest (GET): %s", err)
+	}
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["name"] != "Porridge" {
+		t.Errorf("Expected recipe name to be 'Porridge'. Got '%v'", m["name"])
+	}
+}
+
+func TestImportOversizedLine(t *testing.T) {
+	clearTables()
+
+	jsonl := `{"name":"Pancakes","preptime":20,"difficulty":1}` + "\n" +
+		`{"name":"Porridge","preptime":5,"difficulty":1}` + "\n" +
+		`{"name":"` + strings.Repeat("x", 2*1024*1024) + `"}` + "\n" +
+		`{"name":"Omelette","preptime":10,"difficulty":1}` + "\n"
+
+	req, err := http.NewRequest("POST", "/v1/import", strings.NewReader(jsonl))
+	if err != nil {
+		t.Errorf("Error on http.NewRequest (POST): %s", err)
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusInternalServerError, response)
+
+	// The rows before the oversized line are stored, not just counted
+	var report recipes.ImportReport
+	json.Unmarshal(response.Body.Bytes(), &report)
+	if report.Read != 2 || report.Imported != 2 || report.ResumeFrom != 3 || report.Error == "" {
+		t.Errorf("Expected 2 read and imported, resuming from line 3. Got %+v", report)
+	}
+
+	req, err = http.NewRequest("GET", "/v1/recipes/2", nil)
+	if err != nil {
+		t.Errorf("Error on http.NewRequest (GET): %s", err)
+	}
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response)
+}
+
+func TestExport(t *testing.T) {
+	clearTables()
+	addRecipes(1, 2)
+
+	payload := []byte(`{"rating":4}`)
+
+	req, err := http.NewRequest("POST", "/v1/recipes/1/rating", bytes.NewBuffer(payload))
+	if err != nil {
+		t.Errorf("Error on http.NewRequest (POST): %s", err)
+	}
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response)
+
+	// Sleep the specified number of seconds to allow Couchbase time to commit
+	time.Sleep(sleepTime * time.Second)
+
+	lines := map[string]int{"jsonl": 2, "csv": 3}
+	for format, count := range lines {
+		req, err := http.NewRequest("GET", "/v1/export?format="+format, nil)
+		if err != nil {
+			t.Errorf("Error on http.NewRequest (GET %s): %s", format, err)
+		}
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response)
+
+		body := strings.TrimSpace(response.Body.String())
+		if n := len(strings.Split(body, "\n")); n != count {
+			t.Errorf("Expected '%d' lines of %s. Got '%d'", count, format, n)
+		}
+		if !strings.Contains(body, "4") {
+			t.Errorf("Expected the %s export to include ratings. Got '%s'", format, body)
+		}
+	}
+
+	req, err = http.NewRequest("GET", "/v1/export?format=json", nil)
+	if err != nil {
+		t.Errorf("Error on http.NewRequest (GET json): %s", err)
+	}
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response)
+
+	var exported []recipes.ExportedRecipe
+	if err := json.Unmarshal(response.Body.Bytes(), &exported); err != nil {
+		t.Errorf("Expected a JSON array. Got error '%s'", err)
+	}
+	if len(exported) != 2 {
+		t.Fatalf("Expected '2' recipes. Got '%v'", len(exported))
+	}
+	for i, r := range exported {
+		if id := strconv.Itoa(i + 1); r.ID != id {
+			t.Errorf("Expected recipe '%s' in key order. Got '%s'", id, r.ID)
+		}
+	}
+	if strings.Contains(response.Body.String(), "schema_version") {
+		t.Errorf("Expected no internal 'schema_version' in the export. Got '%s'", response.Body.String())
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	clearTables()
+
+	for i := 0; i < 2; i++ {
+		payload := []byte(`{"name":"test recipe","preptime":0.1,"difficulty":2,"vegetarian":true}`)
+
+		req, err := http.NewRequest("POST", "/v1/recipes", bytes.NewBuffer(payload))
+		if err != nil {
+			t.Errorf("Error on http.NewRequest (POST): %s", err)
+		}
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusCreated, response)
+	}
+
+	var archive bytes.Buffer
+	report, err := recipes.Backup(app.DB, &archive)
+	if err != nil {
+		t.Fatalf("Backup failed: %s", err)
+	}
+	if report.Documents != 2 || report.Counters["idGeneratorForRecipes"] != 2 {
+		t.Errorf("Expected '2' documents and counter '2'. Got '%+v'", report)
+	}
+
+	if _, err := recipes.Restore(app.DB, bytes.NewReader(archive.Bytes()), false); err != recipes.ErrBucketNotEmpty {
+		t.Errorf("Expected '%s' restoring into a full bucket. Got '%v'", recipes.ErrBucketNotEmpty, err)
+	}
+
+	clearTables()
+
+	// A truncated archive is rejected before anything is written
+	truncated := archive.Bytes()[:archive.Len()-20]
+	if _, err := recipes.Restore(app.DB, bytes.NewReader(truncated), false); err != recipes.ErrInvalidBackup {
+		t.Errorf("Expected '%s' restoring a truncated archive. Got '%v'", recipes.ErrInvalidBackup, err)
+	}
+	req, _ := http.NewRequest("GET", "/v1/recipes/1", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response)
+
+	if _, err := recipes.Restore(app.DB, bytes.NewReader(archive.Bytes()), false); err != nil {
+		t.Fatalf("Restore failed: %s", err)
+	}
+
+	req, _ = http.NewRequest("GET", "/v1/recipes/2", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response)
+
+	// The counter was restored, so a new recipe does not collide
+	payload := []byte(`{"name":"new recipe","preptime":0.1,"difficulty":2,"vegetarian":true}`)
+
+	req, _ = http.NewRequest("POST", "/v1/recipes", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response)
+
+	req, _ = http.NewRequest("GET", "/v1/recipes/3", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["name"] != "new recipe" {
+		t.Errorf("Expected the new recipe to be '3'. Got '%v'", m["name"])
+	}
+}
+
+func TestContentNegotiation(t *testing.T) {
+	clearTables()
+
+	payload := []byte("name: yaml recipe\npreptime: 0.5\ndifficulty: 2\nvegetarian: true\ntags: [quick]\n")
+
+	req, err := http.NewRequest("POST", "/v1/recipes", bytes.NewBuffer(payload))
+	if err != nil {
+		t.Errorf("Error on http.NewRequest (POST yaml): %s", err)
+	}
+	req.Header.Set("Content-Type", "application/yaml")
+	req.Header.Set("Accept", "application/xml")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response)
+
+	if contentType := response.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "application/xml") {
+		t.Errorf("Expected an XML response. Got '%s'", contentType)
+	}
+	body := response.Body.String()
+	for _, element := range []string{"<name>yaml recipe</name>", "<preptime>0.5</preptime>", "<tags><item>quick</item></tags>"} {
+		if !strings.Contains(body, element) {
+			t.Errorf("Expected the response to contain '%s'. Got '%s'", element, body)
+		}
+	}
+
+	payload = []byte(`<recipe><name>xml recipe</name><preptime>1</preptime><difficulty>3</difficulty><vegetarian>false</vegetarian></recipe>`)
+
+	req, _ = http.NewRequest("PUT", "/v1/recipes/1", bytes.NewBuffer(payload))
+	req.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	req.Header.Set("Accept", "text/html;q=0.9, application/yaml")
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response)
+
+	if body := response.Body.String(); !strings.Contains(body, "name: xml recipe") {
+		t.Errorf("Expected a YAML response. Got '%s'", body)
+	}
+
+	// Only the typed fields are coerced, so text which looks like a number stays a string
+	payload = []byte(`<recipe><name>1984</name><preptime>1</preptime><difficulty>3</difficulty><vegetarian>true</vegetarian><tags><item>true</item></tags></recipe>`)
+
+	req, _ = http.NewRequest("PUT", "/v1/recipes/1", bytes.NewBuffer(payload))
+	req.Header.Set("Content-Type", "application/xml")
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["name"] != "1984" || m["vegetarian"] != true {
+		t.Errorf("Expected recipe name '1984' and vegetarian 'true'. Got '%v' and '%v'", m["name"], m["vegetarian"])
+	}
+
+	req, _ = http.NewRequest("GET", "/v1/recipes/1", nil)
+	req.Header.Set("Accept", "image/png")
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotAcceptable, response)
+
+	req, _ = http.NewRequest("POST", "/v1/recipes", bytes.NewBufferString("name=form"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusUnsupportedMediaType, response)
+}
+
+func TestRecipeCard(t *testing.T) {
+	clearTables()
+	addRecipes(1, 1)
+
+	payload := []byte(`{"rating":4}`)
+
+	req, _ := http.NewRequest("POST", "/v1/recipes/1/rating", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response)
+
+	cards := []struct {
+		accept   string
+		contains []string
+	}{
+		{"text/markdown", []string{"# Recipe 1", "**Vegetarian**", "★★★★☆"}},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", []string{"<h1>Recipe 1</h1>", "Vegetarian", "★★★★☆"}},
+	}
+	for _, card := range cards {
+		req, _ := http.NewRequest("GET", "/v1/recipes/1", nil)
+		req.Header.Set("Accept", card.accept)
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response)
+
+		body := response.Body.String()
+		for _, s := range card.contains {
+			if !strings.Contains(body, s) {
+				t.Errorf("Expected the card for '%s' to contain '%s'. Got '%s'", card.accept, s, body)
+			}
+		}
+	}
+
+	// Cards are only offered for a single recipe
+	req, _ = http.NewRequest("GET", "/v1/recipes", nil)
+	req.Header.Set("Accept", "text/markdown")
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotAcceptable, response)
+}
+
+func TestJSONLDRoundTrip(t *testing.T) {
+	clearTables()
+
+	payload := []byte(`{
+		"@context": "https://schema.org",
+		"@type": "Recipe",
+		"name": "Lentil soup",
+		"prepTime": "PT1H30M",
+		"suitableForDiet": "https://schema.org/VeganDiet",
+		"keywords": "soup, winter",
+		"additionalProperty": [{"@type": "PropertyValue", "name": "difficulty", "value": 2}]
+	}`)
+
+	req, _ := http.NewRequest("POST", "/v1/recipes", bytes.NewBuffer(payload))
+	req.Header.Set("Content-Type", "application/ld+json")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response)
+
+	var r recipes.Recipe
+	json.Unmarshal(response.Body.Bytes(), &r)
+	if r.Name != "Lentil soup" || r.PrepTime != 90 || r.Difficulty != 2 || !r.Vegetarian || len(r.Tags) != 2 {
+		t.Errorf("Expected the JSON-LD recipe to be mapped. Got '%+v'", r)
+	}
+
+	getJSONLD := func(id string) recipes.JSONLDRecipe {
+		req, _ := http.NewRequest("GET", "/v1/recipes/"+id, nil)
+		req.Header.Set("Accept", "application/ld+json")
+		response := executeRequest(req)
+		checkResponseCode(t, http.StatusOK, response)
+
+		if contentType := response.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "application/ld+json") {
+			t.Errorf("Expected a JSON-LD response. Got '%s'", contentType)
+		}
+		var doc recipes.JSONLDRecipe
+		if err := json.Unmarshal(response.Body.Bytes(), &doc); err != nil {
+			t.Errorf("Expected a JSON-LD document. Got error '%s'", err)
+		}
+		return doc
+	}
+
+	first := getJSONLD("1")
+	if first.PrepTime != "PT1H30M" || first.SuitableForDiet[0] != "https://schema.org/VegetarianDiet" {
+		t.Errorf("Expected prepTime 'PT1H30M' and a vegetarian diet. Got '%+v'", first)
+	}
+
+	// Posting the document back gives an identical recipe
+	body, _ := json.Marshal(first)
+	req, _ = http.NewRequest("POST", "/v1/recipes", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/ld+json")
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response)
+
+	second := getJSONLD("2")
+	second.Identifier = first.Identifier
+	want, _ := json.Marshal(first)
+	got, _ := json.Marshal(second)
+	if string(got) != string(want) {
+		t.Errorf("Expected the round trip to give '%s'. Got '%s'", want, got)
+	}
+
+	req, _ = http.NewRequest("POST", "/v1/recipes", bytes.NewBufferString(`{"@type":"Person","name":"Not a recipe"}`))
+	req.Header.Set("Content-Type", "application/ld+json")
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response)
+}
+
+func TestMetrics(t *testing.T) {
+	clearTables()
+	addRecipes(1, 1)
+
+	req, _ := http.NewRequest("GET", "/v1/recipes/1", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response)
+
+	req, _ = http.NewRequest("GET", "/v1/recipes/99", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response)
+
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response)
+
+	body := response.Body.String()
+	for _, metric := range []string{
+		`http_requests_total{method="GET",route="/v1/recipes/{id:[0-9]+}",status="200"}`,
+		`http_requests_total{method="GET",route="/v1/recipes/{id:[0-9]+}",status="404"}`,
+		`http_request_duration_seconds_bucket{method="GET",route="/v1/recipes/{id:[0-9]+}",status="200"`,
+		`couchbase_operation_duration_seconds_count{operation="get"}`,
+		`couchbase_operation_errors_total{kind="not_found",operation="get"}`,
+	} {
+		if !strings.Contains(body, metric) {
+			t.Errorf("Expected the metrics to include '%s'", metric)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	clearTables()
+	addRecipes(1, 1)
+
+	if _, err := application.InitTracing("none"); err != nil {
+		t.Fatalf("InitTracing failed: %s", err)
+	}
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	req, _ := http.NewRequest("GET", "/v1/recipes/1", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response)
+
+	req, _ = http.NewRequest("GET", "/v1/recipes", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response)
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+
+	server, ok := spans["GET /v1/recipes/{id:[0-9]+}"]
+	if !ok {
+		t.Fatalf("Expected a span for the route. Got '%v'", spans)
+	}
+	if traceID := server.SpanContext().TraceID().String(); traceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Expected the incoming trace to be continued. Got trace '%s'", traceID)
+	}
+	if get, ok := spans["couchbase.get"]; !ok || get.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("Expected a couchbase.get span within the request span")
+	}
+
+	n1ql, ok := spans["couchbase.n1ql"]
+	if !ok {
+		t.Fatalf("Expected a couchbase.n1ql span")
+	}
+	statement := ""
+	for _, attr := range n1ql.Attributes() {
+		if attr.Key == "db.statement" {
+			statement = attr.Value.AsString()
+		}
+	}
+	if !strings.HasPrefix(statement, "SELECT") {
+		t.Errorf("Expected the N1QL statement on the span. Got '%s'", statement)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	clearTables()
+
+	req, _ := http.NewRequest("GET", "/v1/recipes/1", nil)
+	req.Header.Set("X-Request-ID", "test-request-1")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response)
+
+	if id := response.Header().Get("X-Request-ID"); id != "test-request-1" {
+		t.Errorf("Expected the request ID to be echoed. Got '%s'", id)
+	}
+	var m map[string]string
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["request_id"] != "test-request-1" {
+		t.Errorf("Expected the error to include the request ID. Got '%v'", m)
+	}
+
+	req, _ = http.NewRequest("GET", "/v1/recipes", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response)
+
+	if id := response.Header().Get("X-Request-ID"); len(id) != 32 {
+		t.Errorf("Expected a generated request ID. Got '%s'", id)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response)
+
+	req, _ = http.NewRequest("GET", "/readyz", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response)
+
+	var readiness struct {
+		Status string                         `json:"status"`
+		Checks map[string]recipes.CheckResult `json:"checks"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &readiness)
+	if readiness.Status != "ready" {
+		t.Errorf("Expected status 'ready'. Got '%s'", readiness.Status)
+	}
+	for _, check := range []string{"bucket", "query", "indexes"} {
+		if !readiness.Checks[check].OK() {
+			t.Errorf("Expected the '%s' check to pass. Got '%+v'", check, readiness.Checks[check])
+		}
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	clearTables()
+	// Stored as they were before schema versions, ratings, moderation and types
+	addRecipes(1, 3)
+	untype := gocb.NewN1qlQuery("UPDATE recipes UNSET type").Consistency(gocb.RequestPlus)
+	if _, err := app.DB.ExecuteN1qlQuery(untype, nil); err != nil {
+		t.Fatalf("Error removing recipe types: %s", err)
+	}
+
+	// Sleep the specified number of seconds to allow Couchbase time to commit
+	time.Sleep(sleepTime * time.Second)
+
+	// Untyped recipes are listed before they are migrated
+	req, _ := http.NewRequest("GET", "/v1/recipes", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response)
+	var listed []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &listed)
+	if len(listed) != 3 {
+		t.Errorf("Expected '3' untyped recipes listed. Got '%v'", len(listed))
+	}
+
+	// Documents not yet migrated are upgraded as they are read
+	var r recipes.Recipe
+	if err := r.GetRecipe("1", app.DB); err != nil {
+		t.Fatalf("Error getting recipe: %s", err)
+	}
+	if r.Status != recipes.StatusApproved || r.Ratings == nil {
+		t.Errorf("Expected an approved recipe with no ratings. Got '%+v'", r)
+	}
+
+	report, err := recipes.MigrateRecipes(app.DB, nil)
+	if err != nil {
+		t.Fatalf("Error migrating recipes: %s", err)
+	}
+	if report.Migrated != 3 || report.Failed != 0 {
+		t.Errorf("Expected 3 recipes to be migrated. Got '%+v'", report)
+	}
+
+	var doc map[string]interface{}
+	if _, err := app.DB.Get("2", &doc); err != nil {
+		t.Fatalf("Error getting recipe: %s", err)
+	}
+	if doc["schema_version"] != float64(recipes.SchemaVersion()) || doc["type"] != recipes.TypeRecipe ||
+		doc["status"] != recipes.StatusApproved {
+		t.Errorf("Expected a migrated document. Got '%v'", doc)
+	}
+
+	// Running it again finds nothing left to migrate
+	report, err = recipes.MigrateRecipes(app.DB, nil)
+	if err != nil || report.Scanned != 0 {
+		t.Errorf("Expected nothing left to migrate. Got '%+v', %v", report, err)
+	}
+
+	// The service migrates in the background once it is ready
+	unversion := gocb.NewN1qlQuery("UPDATE recipes UNSET type, schema_version").Consistency(gocb.RequestPlus)
+	if _, err := app.DB.ExecuteN1qlQuery(unversion, nil); err != nil {
+		t.Fatalf("Error removing recipe versions: %s", err)
+	}
+	migrating := application.App{SkipIndexes: true, MigrateOnStart: true}
+	migrating.Initialize(
+		os.Getenv("COUCHBASE_USER"),
+		os.Getenv("COUCHBASE_PASS"),
+		os.Getenv("COUCHBASE_DB"))
+	if err := migrating.WaitReady(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Minute); ; time.Sleep(time.Second) {
+		doc = nil
+		if _, err := app.DB.Get("3", &doc); err != nil {
+			t.Fatalf("Error getting recipe: %s", err)
+		}
+		if doc["type"] == recipes.TypeRecipe {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the recipes to be migrated in the background. Got '%v'", doc)
+		}
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	indexes, err := app.Manager.GetIndexes()
+	if err != nil {
+		t.Fatalf("Error listing indexes: %s", err)
+	}
+	online := map[string]bool{}
+	primary := false
+	for _, index := range indexes {
+		online[index.Name] = index.State == "online"
+		if index.IsPrimary && index.State == "online" {
+			primary = true
+		}
+	}
+	if !primary {
+		t.Errorf("Expected an online primary index")
+	}
+	for _, index := range recipes.RequiredIndexes {
+		if !online[index.Name] {
+			t.Errorf("Expected index '%s' to be online", index.Name)
+		}
+	}
+}
+
+func TestTenants(t *testing.T) {
+	// Without a token secret, only admin requests may name a tenant
+	signed := application.App{MultiTenant: true, TenantSecret: []byte("tenant secret"), AdminToken: adminToken}
+	unsigned := application.App{MultiTenant: true, AdminToken: adminToken}
+	for _, tenanted := range []*application.App{&signed, &unsigned} {
+		tenanted.Initialize(
+			os.Getenv("COUCHBASE_USER"),
+			os.Getenv("COUCHBASE_PASS"),
+			os.Getenv("COUCHBASE_DB"))
+		if err := tenanted.WaitReady(time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	do := func(tenanted *application.App, method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		for k, v := range headers {
+			if k == "Host" {
+				req.Host = v
+			} else {
+				req.Header.Set(k, v)
+			}
+		}
+		rr := httptest.NewRecorder()
+		tenanted.Router.ServeHTTP(rr, req)
+		return rr
+	}
+	admin := map[string]string{"X-Admin-Token": adminToken}
+
+	// Left over by an earlier run which failed
+	for _, id := range []string{"acme", "globex"} {
+		do(&signed, "DELETE", "/v1/admin/tenants/"+id, "", admin)
+	}
+
+	// The admin API needs the admin token
+	response := do(&signed, "POST", "/v1/admin/tenants", `{"id":"acme"}`, nil)
+	checkResponseCode(t, http.StatusUnauthorized, response)
+	response = do(&signed, "GET", "/v1/admin/tenants", "", map[string]string{"X-Admin-Token": "wrong token"})
+	checkResponseCode(t, http.StatusUnauthorized, response)
+	response = do(&signed, "DELETE", "/v1/admin/tenants/acme", "", nil)
+	checkResponseCode(t, http.StatusUnauthorized, response)
+
+	response = do(&signed, "POST", "/v1/admin/tenants", `{"id":"acme","hosts":["acme.example.com"]}`, admin)
+	checkResponseCode(t, http.StatusCreated, response)
+	response = do(&signed, "POST", "/v1/admin/tenants", `{"id":"globex","search_index":"globex-recipes"}`, admin)
+	checkResponseCode(t, http.StatusCreated, response)
+	response = do(&signed, "POST", "/v1/admin/tenants", `{"id":"acme"}`, admin)
+	checkResponseCode(t, http.StatusConflict, response)
+	response = do(&signed, "POST", "/v1/admin/tenants", `{"id":"Not A Tenant"}`, admin)
+	checkResponseCode(t, http.StatusBadRequest, response)
+
+	response = do(&signed, "GET", "/v1/admin/tenants/globex", "", admin)
+	checkResponseCode(t, http.StatusOK, response)
+	var tenant map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &tenant)
+	if tenant["search_index"] != "globex-recipes" {
+		t.Errorf("Expected the tenant's search index to be 'globex-recipes'. Got '%v'", tenant["search_index"])
+	}
+	if _, ok := tenant["type"]; ok {
+		t.Errorf("Expected no internal 'type' in the tenant. Got '%v'", tenant["type"])
+	}
+
+	acmeToken := "Bearer " + tenantToken("acme", "tenant secret")
+	payload := `{"name":"tenant recipe","preptime":0.1,"difficulty":2,"vegetarian":true}`
+	response = do(&signed, "POST", "/v1/recipes", payload, map[string]string{"Authorization": acmeToken})
+	checkResponseCode(t, http.StatusCreated, response)
+
+	// Each tenant has its own counters, so the first recipe is always 1
+	for _, e := range []struct {
+		tenanted *application.App
+		headers  map[string]string
+		code     int
+	}{
+		{&signed, map[string]string{"Authorization": acmeToken}, http.StatusOK},
+		{&signed, map[string]string{"Authorization": acmeToken, "X-Tenant-ID": "acme"}, http.StatusOK},
+		{&signed, map[string]string{"Authorization": acmeToken, "X-Tenant-ID": "globex"}, http.StatusForbidden},
+		{&signed, map[string]string{"Authorization": "Bearer " + tenantToken("globex", "tenant secret")}, http.StatusNotFound},
+		{&signed, map[string]string{"Authorization": "Bearer " + tenantToken("acme", "wrong secret")}, http.StatusUnauthorized},
+		{&signed, map[string]string{"X-Tenant-ID": "acme"}, http.StatusUnauthorized},
+		{&signed, map[string]string{"Host": "acme.example.com:8100"}, http.StatusUnauthorized},
+		{&signed, map[string]string{"X-Tenant-ID": "acme", "X-Admin-Token": adminToken}, http.StatusOK},
+		{&signed, nil, http.StatusUnauthorized},
+		{&unsigned, map[string]string{"X-Tenant-ID": "acme"}, http.StatusUnauthorized},
+		{&unsigned, map[string]string{"Host": "acme.example.com:8100"}, http.StatusUnauthorized},
+		{&unsigned, map[string]string{"X-Tenant-ID": "acme", "X-Admin-Token": "wrong token"}, http.StatusUnauthorized},
+		{&unsigned, map[string]string{"X-Tenant-ID": "acme", "X-Admin-Token": adminToken}, http.StatusOK},
+		{&unsigned, map[string]string{"Host": "acme.example.com:8100", "X-Admin-Token": adminToken}, http.StatusOK},
+		{&unsigned, map[string]string{"X-Tenant-ID": "globex", "X-Admin-Token": adminToken}, http.StatusNotFound},
+		{&unsigned, map[string]string{"X-Tenant-ID": "initech", "X-Admin-Token": adminToken}, http.StatusNotFound},
+		{&unsigned, map[string]string{"Authorization": acmeToken}, http.StatusUnauthorized},
+		{&unsigned, admin, http.StatusBadRequest},
+	} {
+		response = do(e.tenanted, "GET", "/v1/recipes/1", "", e.headers)
+		if response.Code != e.code {
+			t.Errorf("Expected response code %d with %v. Got %d", e.code, e.headers, response.Code)
+		}
+	}
+
+	for _, id := range []string{"acme", "globex"} {
+		response = do(&signed, "DELETE", "/v1/admin/tenants/"+id, "", admin)
+		checkResponseCode(t, http.StatusOK, response)
+	}
+	response = do(&signed, "GET", "/v1/admin/tenants/acme", "", admin)
+	checkResponseCode(t, http.StatusNotFound, response)
+
+	// A removed tenant's store is closed, and no longer served
+	response = do(&signed, "GET", "/v1/recipes/1", "", map[string]string{"Authorization": acmeToken})
+	checkResponseCode(t, http.StatusNotFound, response)
+}
+
+// tenantToken returns a HS256 JWT with a tenant claim
+func tenantToken(tenant, secret string) string {
+	encode := base64.RawURLEncoding.EncodeToString
+	token := encode([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + encode([]byte(`{"tenant":"`+tenant+`"}`))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(token))
+	return token + "." + encode(mac.Sum(nil))
+}
+
+func TestNotReady(t *testing.T) {
+	// An app whose bucket does not exist keeps retrying, and is never ready
+	unready := application.App{ConnectAttempts: 1000}
+	unready.Initialize(
+		os.Getenv("COUCHBASE_USER"),
+		os.Getenv("COUCHBASE_PASS"),
+		"no-such-bucket")
+
+	if err := unready.WaitReady(time.Second); err == nil {
+		t.Errorf("Expected an error waiting for a bucket which does not exist")
+	}
+
+	for path, code := range map[string]int{
+		"/healthz":    http.StatusOK,
+		"/readyz":     http.StatusServiceUnavailable,
+		"/v1/recipes": http.StatusServiceUnavailable,
+	} {
+		req, _ := http.NewRequest("GET", path, nil)
+		rr := httptest.NewRecorder()
+		unready.Router.ServeHTTP(rr, req)
+		if rr.Code != code {
+			t.Errorf("Expected response code %d for %s. Got %d", code, path, rr.Code)
+		}
+	}
+}
+
+func TestModeration(t *testing.T) {
+	clearTables()
+
+	payload := []byte(`{"name":"yuck pie","preptime":5.0,"difficulty":1,"vegetarian":true}`)
+
+	req, err := http.NewRequest("POST", "/v1/recipes", bytes.NewBuffer(payload))
+	if err != nil {
+		t.Errorf("Error on http.NewRequest (POST): %s", err)
+	}
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusCreated, response)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["status"] != "pending" {
+		t.Errorf("Expected recipe status to be 'pending'. Got '%v'", m["status"])
+	}
+
+	addRecipes(2, 1)
+
+	// Sleep the specified number of seconds to allow Couchbase time to commit
+	time.Sleep(sleepTime * time.Second)
+
+	req, err = http.NewRequest("GET", "/v1/recipes", nil)
+	if err != nil {
+		t.Errorf("Error on http.NewRequest (GET): %s", err)
+	}
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response)
+
+	var mm []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &mm)
+	if len(mm) != 1 {
+		t.Errorf("Expected '1' visible recipe. Got '%v'", len(mm))
+	}
+
+	// The admin API needs the admin token
+	req, err = http.NewRequest("GET", "/v1/admin/moderation", nil)
+	if err != nil {
+		t.Errorf("Error on http.NewRequest (GET queue): %s", err)
+	}
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, response)
+
+	req.Header.Set("X-Admin-Token", "wrong token")
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, response)
+
+	req.Header.Set("X-Admin-Token", adminToken)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response)
+
+	json.Unmarshal(response.Body.Bytes(), &mm)
+	if len(mm) != 1 {
+		t.Errorf("Expected '1' recipe in the moderation queue. Got '%v'", len(mm))
+	}
+
+	req, err = http.NewRequest("POST", "/v1/admin/moderation/1/approve", nil)
+	if err != nil {
+		t.Errorf("Error on http.NewRequest (POST approve): %s", err)
+	}
+	req.Header.Set("X-Admin-Token", adminToken)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response)
+
+	// Sleep the specified number of seconds to allow Couchbase time to commit
+	time.Sleep(sleepTime * time.Second)
+
+	req, err = http.NewRequest("GET", "/v1/recipes", nil)
+	if err != nil {
+		t.Errorf("Error on http.NewRequest (Second GET): %s", err)
+	}
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, response)
+
+	json.Unmarshal(response.Body.Bytes(), &mm)
+	if len(mm) != 2 {
+		t.Errorf("Expected '2' visible recipes. Got '%v'", len(mm))
+	}
+}
+
 func addRecipes(start, count int) {
 	if count < 1 {
 		count = 1
 	}
 	for i := 0; i < count; i++ {
 
-		insertRecipe := gocb.NewN1qlQuery("INSERT INTO recipes (KEY, VALUE) VALUES ($1, {'name':$2,'preptime':$3,'difficulty':$4,'vegetarian':$5})")
+		insertRecipe := gocb.NewN1qlQuery("INSERT INTO recipes (KEY, VALUE) VALUES ($1, {'type':'recipe','name':$2,'preptime':$3,'difficulty':$4,'vegetarian':$5})")
 
 		id := strconv.Itoa(start)
 		nameID := strconv.Itoa(i + 1)